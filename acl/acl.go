@@ -0,0 +1,206 @@
+package acl
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"myGoRPC/codes"
+	"myGoRPC/status"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"gopkg.in/yaml.v3"
+)
+
+/*
+Rule
+一条允许规则：Principals 中的调用方可以调用 Methods 中的方法。
+Methods 按 path.Match 匹配，形如 "Arith.Sum"、"Arith.*"（整个服务）、"*"（所有方法）；
+Principals 为 auth.Principal.Name，只支持 '*' 通配任意字符（包括 '/'），例如 "team/*"、"spiffe://example.org/*"，
+"*" 匹配任意调用方，包括没有认证的调用方
+*/
+type Rule struct {
+	Principals []string `json:"principals" yaml:"principals"`
+	Methods    []string `json:"methods" yaml:"methods"`
+}
+
+/*
+Policy
+访问控制策略，没有任何规则允许的调用被拒绝；
+DryRun 为 true 时只记录违反策略的调用，不拒绝，用于上线新策略前观察
+*/
+type Policy struct {
+	DryRun bool   `json:"dry_run" yaml:"dry_run"`
+	Rules  []Rule `json:"rules" yaml:"rules"`
+}
+
+// validate 检查 Methods 的模式是否合法，避免匹配时才发现错误
+func (p *Policy) validate() error {
+	for i, r := range p.Rules {
+		for _, pattern := range r.Methods {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("acl: rule %d: bad pattern %q", i, pattern)
+			}
+		}
+	}
+	return nil
+}
+
+// Allowed principal 是否可以调用 service.method，nil 的 Policy 拒绝所有调用
+func (p *Policy) Allowed(principal, service, method string) bool {
+	if p == nil {
+		return false
+	}
+	serviceMethod := service + "." + method
+	for _, r := range p.Rules {
+		if match(r.Principals, principal, wildcard) && match(r.Methods, serviceMethod, pathMatch) {
+			return true
+		}
+	}
+	return false
+}
+
+func match(patterns []string, s string, f func(pattern, s string) bool) bool {
+	for _, pattern := range patterns {
+		if f(pattern, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func pathMatch(pattern, s string) bool {
+	ok, _ := path.Match(pattern, s)
+	return ok
+}
+
+// wildcard '*' 匹配任意字符串（包括 '/'），其余字符按原样比较
+func wildcard(pattern, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == s
+	}
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, part)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+	return strings.HasSuffix(s, parts[len(parts)-1])
+}
+
+/*
+Parse
+解析 JSON 或 YAML 格式的 Policy，format 为 "json"、"yaml"
+*/
+func Parse(data []byte, format string) (*Policy, error) {
+	var p Policy
+	var err error
+	switch format {
+	case "json":
+		err = json.Unmarshal(data, &p)
+	case "yaml":
+		err = yaml.Unmarshal(data, &p)
+	default:
+		return nil, fmt.Errorf("acl: unsupported format %q", format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("acl: parse %s policy: %w", format, err)
+	}
+	if err = p.validate(); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+/*
+ACL
+Server 使用的访问控制，当前的 Policy 可以在运行时原子地替换（Set、Reload），
+正在进行的检查不受影响
+*/
+type ACL struct {
+	path   string // Load 的文件，Reload 时重新读取
+	policy atomic.Pointer[Policy]
+}
+
+// New p 为 nil 时拒绝所有调用
+func New(p *Policy) *ACL {
+	a := &ACL{}
+	a.Set(p)
+	return a
+}
+
+/*
+Load
+从文件加载 Policy，按扩展名区分格式：.json，.yaml 或者 .yml
+*/
+func Load(file string) (*ACL, error) {
+	a := &ACL{path: file}
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+/*
+Reload
+重新读取 Load 的文件，失败时保留原来的 Policy 并返回错误；
+可以在收到 SIGHUP 等信号时调用
+*/
+func (a *ACL) Reload() error {
+	if a.path == "" {
+		return fmt.Errorf("acl: not loaded from a file")
+	}
+	data, err := os.ReadFile(a.path)
+	if err != nil {
+		return fmt.Errorf("acl: %w", err)
+	}
+	format := "json"
+	switch filepath.Ext(a.path) {
+	case ".yaml", ".yml":
+		format = "yaml"
+	}
+	p, err := Parse(data, format)
+	if err != nil {
+		return err
+	}
+	a.policy.Store(p)
+	return nil
+}
+
+// Set p 为 nil 时拒绝所有调用
+func (a *ACL) Set(p *Policy) {
+	if p == nil {
+		p = &Policy{}
+	}
+	a.policy.Store(p)
+}
+
+func (a *ACL) Policy() *Policy {
+	return a.policy.Load()
+}
+
+/*
+Check
+principal 不能调用 service.method 时返回 codes.PermissionDenied；
+DryRun 时只记录日志，返回 nil
+*/
+func (a *ACL) Check(principal, service, method string) error {
+	p := a.policy.Load()
+	if p.Allowed(principal, service, method) {
+		return nil
+	}
+	if p != nil && p.DryRun {
+		log.Printf("acl: dry run, %q is not allowed to call %s.%s", principal, service, method)
+		return nil
+	}
+	return status.Errorf(codes.PermissionDenied, "acl: %q is not allowed to call %s.%s", principal, service, method)
+}
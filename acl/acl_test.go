@@ -0,0 +1,60 @@
+package acl
+
+import (
+	"fmt"
+	"myGoRPC/codes"
+	"myGoRPC/status"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func _assert(condition bool, msg string, v ...interface{}) {
+	if !condition {
+		panic(fmt.Sprintf("assertion failed: "+msg, v...))
+	}
+}
+
+const yamlPolicy = `
+rules:
+  - principals: [alice]
+    methods: ["Arith.*"]
+  - principals: ["*"]
+    methods: [Health.Check]
+`
+
+func TestACL(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "policy.yaml")
+	_assert(os.WriteFile(file, []byte(yamlPolicy), 0o600) == nil, "failed to write policy")
+	a, err := Load(file)
+	_assert(err == nil, "failed to load: %v", err)
+
+	_assert(a.Check("alice", "Arith", "Sum") == nil, "alice may call the whole Arith service")
+	_assert(a.Check("", "Health", "Check") == nil, "anyone may call Health.Check")
+	_assert(a.Check("spiffe://example.org/ns/web", "Health", "Check") == nil, "\"*\" should match principals containing '/'")
+	err = a.Check("bob", "Arith", "Sum")
+	_assert(status.Code(err) == codes.PermissionDenied, "expect PermissionDenied, got %v", err)
+
+	// 重新加载：非法的策略不会替换原来的策略
+	_assert(os.WriteFile(file, []byte(`rules: [{principals: ["*"], methods: ["["]}]`), 0o600) == nil, "failed to write policy")
+	_assert(a.Reload() != nil && a.Check("alice", "Arith", "Sum") == nil, "bad policy should be rejected")
+
+	file = filepath.Join(t.TempDir(), "policy.json")
+	_assert(os.WriteFile(file, []byte(`{"dry_run": true, "rules": [{"principals": ["bob"], "methods": ["*"]}]}`), 0o600) == nil, "failed to write policy")
+	a, err = Load(file)
+	_assert(err == nil, "failed to load json: %v", err)
+	_assert(a.Check("alice", "Arith", "Sum") == nil, "dry run only logs violations")
+	_assert(!a.Policy().Allowed("alice", "Arith", "Sum") && a.Policy().Allowed("bob", "Arith", "Sum"), "wrong policy")
+	a.Set(&Policy{})
+	_assert(status.Code(a.Check("bob", "Arith", "Sum")) == codes.PermissionDenied, "empty policy denies everything")
+	_assert(status.Code(New(nil).Check("bob", "Arith", "Sum")) == codes.PermissionDenied, "nil policy denies everything")
+	_assert(!(*Policy)(nil).Allowed("bob", "Arith", "Sum"), "nil policy denies everything")
+
+	p := &Policy{Rules: []Rule{{Principals: []string{"team/*", "spiffe://*/web"}, Methods: []string{"*"}}}}
+	for principal, allowed := range map[string]bool{
+		"team/alice": true, "team/ops/bob": true, "team": false,
+		"spiffe://example.org/ns/web": true, "spiffe://example.org/ns/db": false,
+	} {
+		_assert(p.Allowed(principal, "Arith", "Sum") == allowed, "%q: expect allowed %v", principal, allowed)
+	}
+}
@@ -0,0 +1,97 @@
+package myGoRPC
+
+import (
+	"context"
+	"myGoRPC/auth"
+	"myGoRPC/codec"
+	"myGoRPC/codes"
+	"myGoRPC/status"
+)
+
+/*
+认证
+
+设置了 Server.Authenticator 时，凭证有两个来源：
+1. 握手时的 Option.Token，认证连接，不合法时握手失败（codes.Unauthenticated），serveCodec 不会开始；
+   Server.RequireConnAuth 为 true 时没有 Option.Token 的连接同样在握手时被拒绝
+2. 每次调用的请求 Metadata 中的 auth.MetadataKey（见 auth.WithToken），认证这一次调用，优先于连接的凭证
+
+两者都没有的调用回复 codes.Unauthenticated。
+每次调用的认证（可能访问外部服务）与 ACL 检查在处理请求的协程中进行（见 authorize），不阻塞连接的读循环。
+通过认证的 auth.Principal 放入请求的 context，方法与拦截器通过 auth.FromContext 读取
+*/
+
+// authenticateConn token 为空时不认证连接，之后的调用需要各自携带凭证；RequireConnAuth 时拒绝
+func (server *Server) authenticateConn(ctx context.Context, token string) (context.Context, error) {
+	if server.Authenticator == nil {
+		return ctx, nil
+	}
+	if token == "" {
+		if server.RequireConnAuth {
+			return ctx, status.Error(codes.Unauthenticated, "rpc server: missing connection credentials")
+		}
+		return ctx, nil
+	}
+	p, err := server.Authenticator.Authenticate(ctx, token)
+	if err != nil {
+		return ctx, unauthenticated(err)
+	}
+	return auth.NewContext(ctx, p), nil
+}
+
+// callToken 取出调用的凭证，并从 h.Metadata 中移除，不会交给方法
+func (server *Server) callToken(h *codec.Header) string {
+	if server.Authenticator == nil {
+		return ""
+	}
+	token := h.Metadata[auth.MetadataKey]
+	delete(h.Metadata, auth.MetadataKey)
+	return token
+}
+
+/*
+authorize
+认证调用（见 authenticateCall），然后按 Server.ACL 检查权限，通过认证的 auth.Principal 放入 req.ctx；
+在处理请求的协程中调用，Authenticator 较慢时不会阻塞读循环
+*/
+func (server *Server) authorize(req *request) error {
+	ctx, err := server.authenticateCall(req.ctx, req.token)
+	if err != nil {
+		return err
+	}
+	req.ctx = ctx
+	if server.ACL == nil {
+		return nil
+	}
+	var principal string
+	if p, ok := auth.FromContext(ctx); ok {
+		principal = p.Name
+	}
+	return server.ACL.Check(principal, req.header.Service, req.header.Method)
+}
+
+// authenticateCall token 为空时使用连接的身份
+func (server *Server) authenticateCall(ctx context.Context, token string) (context.Context, error) {
+	if server.Authenticator == nil {
+		return ctx, nil
+	}
+	if token != "" {
+		p, err := server.Authenticator.Authenticate(ctx, token)
+		if err != nil {
+			return ctx, unauthenticated(err)
+		}
+		return auth.NewContext(ctx, p), nil
+	}
+	if _, ok := auth.FromContext(ctx); ok {
+		return ctx, nil
+	}
+	return ctx, status.Error(codes.Unauthenticated, "rpc server: missing credentials")
+}
+
+// unauthenticated 没有错误码的 error 视为 codes.Unauthenticated
+func unauthenticated(err error) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	return status.Error(codes.Unauthenticated, "rpc server: "+err.Error())
+}
@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"context"
+	"myGoRPC/codes"
+	"myGoRPC/metadata"
+	"myGoRPC/status"
+)
+
+// MetadataKey 每次调用的凭证在请求 Metadata 中的 key，见 WithToken
+const MetadataKey = "authorization"
+
+/*
+Principal
+通过认证的调用方，服务端放入请求的 context，方法与拦截器通过 FromContext 读取
+*/
+type Principal struct {
+	Name  string            // 身份，例如用户名、服务名
+	Attrs map[string]string // 附加信息，例如角色、租户
+}
+
+/*
+Authenticator
+验证客户端的凭证（token），返回调用方的身份；返回错误即拒绝，
+没有错误码的 error 视为 codes.Unauthenticated。
+ctx 携带连接的 peer.Peer，可以结合 TLS 客户端证书判断
+*/
+type Authenticator interface {
+	Authenticate(ctx context.Context, token string) (*Principal, error)
+}
+
+type AuthenticatorFunc func(ctx context.Context, token string) (*Principal, error)
+
+func (f AuthenticatorFunc) Authenticate(ctx context.Context, token string) (*Principal, error) {
+	return f(ctx, token)
+}
+
+// Tokens 静态的 token 表，键为 token，值为 Principal.Name
+type Tokens map[string]string
+
+func (t Tokens) Authenticate(_ context.Context, token string) (*Principal, error) {
+	name, ok := t[token]
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "auth: invalid token")
+	}
+	return &Principal{Name: name}, nil
+}
+
+type principalKey struct{}
+
+func NewContext(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+func FromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(*Principal)
+	return p, ok
+}
+
+/*
+WithToken
+客户端：为一次调用附加凭证，随请求 Metadata 发送，服务端据此认证这次调用，优先于握手时的 Option.Token
+*/
+func WithToken(ctx context.Context, token string) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, MetadataKey, token)
+}
@@ -0,0 +1,155 @@
+package myGoRPC
+
+import (
+	"context"
+	"myGoRPC/acl"
+	"myGoRPC/auth"
+	"myGoRPC/codec"
+	"myGoRPC/codes"
+	"myGoRPC/metadata"
+	"myGoRPC/status"
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+type Me int
+
+// Name 返回调用方的身份，请求 Metadata 中的凭证不应交给方法
+func (m Me) Name(ctx context.Context, _ int, reply *string) error {
+	p, _ := auth.FromContext(ctx)
+	md, _ := metadata.FromIncomingContext(ctx)
+	*reply = p.Name + md.Get(auth.MetadataKey)
+	return nil
+}
+
+/*
+测试认证。
+握手时的凭证不合法时无法连接；每次调用的凭证优先于连接的凭证；没有凭证的调用被拒绝；
+身份对方法与拦截器可见
+*/
+func TestServer_Authenticate(t *testing.T) {
+	t.Parallel()
+	server := &Server{Authenticator: auth.Tokens{"t1": "alice", "t2": "bob"}}
+	_ = server.Register(new(Me))
+	var intercepted int32
+	server.Use(func(ctx context.Context, info *ServerInfo, args, reply interface{}, next Handler) error {
+		if p, ok := auth.FromContext(ctx); ok && p.Name != "" {
+			atomic.AddInt32(&intercepted, 1)
+		}
+		return next(ctx, args, reply)
+	})
+	l, err := net.Listen("tcp", ":0")
+	_assert(err == nil, "failed to listen: %v", err)
+	go server.Accept(l)
+	t.Cleanup(func() { _ = server.Close() })
+	addr := l.Addr().String()
+
+	_, err = Dial("tcp", addr, &Option{Token: "bad"})
+	_assert(status.Code(err) == codes.Unauthenticated, "expect Unauthenticated dialing with a bad token, got %v", err)
+	_, err = Dial("tcp", addr, &Option{Token: "bad", LegacyHandshake: true, CodecTypes: []codec.Type{codec.GobType}})
+	_assert(err != nil, "expect legacy handshake with a bad token to fail")
+
+	client, err := Dial("tcp", addr, &Option{Token: "t1"})
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+	var name string
+	err = client.Call(context.Background(), "Me", "Name", 0, &name)
+	_assert(err == nil && name == "alice", "expect alice, got %q, err %v", name, err)
+	err = client.Call(auth.WithToken(context.Background(), "t2"), "Me", "Name", 0, &name)
+	_assert(err == nil && name == "bob", "expect bob, got %q, err %v", name, err)
+	err = client.Call(auth.WithToken(context.Background(), "bad"), "Me", "Name", 0, &name)
+	_assert(status.Code(err) == codes.Unauthenticated, "expect Unauthenticated with a bad call token, got %v", err)
+
+	anonymous, err := Dial("tcp", addr)
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = anonymous.Close() }()
+	err = anonymous.Call(context.Background(), "Me", "Name", 0, &name)
+	_assert(status.Code(err) == codes.Unauthenticated, "expect Unauthenticated without credentials, got %v", err)
+	err = anonymous.Call(auth.WithToken(context.Background(), "t1"), "Me", "Name", 0, &name)
+	_assert(err == nil && name == "alice", "expect alice, got %q, err %v", name, err)
+	_assert(atomic.LoadInt32(&intercepted) == 3, "interceptor should see 3 principals, got %d", intercepted)
+}
+
+/*
+测试 RequireConnAuth 与不阻塞读循环的认证。
+没有连接凭证时握手失败；一次调用的认证较慢时，同一连接上的其他调用不受影响；
+出错的请求携带凭证时，认证同样计入 MaxInflight
+*/
+func TestServer_RequireConnAuth(t *testing.T) {
+	t.Parallel()
+	entered, release := make(chan struct{}), make(chan struct{})
+	authenticator := auth.AuthenticatorFunc(func(ctx context.Context, token string) (*auth.Principal, error) {
+		if token == "slow" {
+			entered <- struct{}{}
+			<-release
+		}
+		return &auth.Principal{Name: token}, nil
+	})
+	dial := func(server *Server, opt *Option) (*Client, error) {
+		_ = server.Register(new(Me))
+		l, err := net.Listen("tcp", ":0")
+		_assert(err == nil, "failed to listen: %v", err)
+		go server.Accept(l)
+		t.Cleanup(func() { _ = server.Close() })
+		return Dial("tcp", l.Addr().String(), opt)
+	}
+
+	_, err := dial(&Server{RequireConnAuth: true, Authenticator: authenticator}, nil)
+	_assert(status.Code(err) == codes.Unauthenticated, "expect Unauthenticated dialing without a token, got %v", err)
+
+	client, err := dial(&Server{RequireConnAuth: true, Authenticator: authenticator}, &Option{Token: "alice"})
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+	var slow string
+	done := make(chan error, 1)
+	go func() { done <- client.Call(auth.WithToken(context.Background(), "slow"), "Me", "Name", 0, &slow) }()
+	<-entered
+	var name string
+	err = client.Call(context.Background(), "Me", "Name", 0, &name)
+	_assert(err == nil && name == "alice", "expect alice while another call is authenticating, got %q, err %v", name, err)
+	release <- struct{}{}
+	_assert(<-done == nil && slow == "slow", "expect the slow call to finish, got %q", slow)
+
+	client, err = dial(&Server{Authenticator: authenticator, MaxInflight: 1}, &Option{Token: "alice"})
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+	go func() { done <- client.Call(auth.WithToken(context.Background(), "slow"), "Me", "Missing", 0, &slow) }()
+	<-entered
+	err = client.Call(auth.WithToken(context.Background(), "slow"), "Me", "Missing", 0, &name)
+	_assert(status.Code(err) == codes.ResourceExhausted, "expect ResourceExhausted while a failed call is authenticating, got %v", err)
+	release <- struct{}{}
+	err = <-done
+	_assert(status.Code(err) == codes.NotFound, "expect NotFound after authentication, got %v", err)
+}
+
+/*
+测试访问控制。
+没有权限时回复 PermissionDenied，且无法得知方法是否存在；策略可以在运行时替换
+*/
+func TestServer_ACL(t *testing.T) {
+	t.Parallel()
+	policy := acl.New(&acl.Policy{Rules: []acl.Rule{{Principals: []string{"alice"}, Methods: []string{"Me.*"}}}})
+	server := &Server{Authenticator: auth.Tokens{"t1": "alice", "t2": "bob"}, ACL: policy}
+	_ = server.Register(new(Me))
+	l, err := net.Listen("tcp", ":0")
+	_assert(err == nil, "failed to listen: %v", err)
+	go server.Accept(l)
+	t.Cleanup(func() { _ = server.Close() })
+
+	client, err := Dial("tcp", l.Addr().String(), &Option{Token: "t1"})
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+	var name string
+	err = client.Call(context.Background(), "Me", "Name", 0, &name)
+	_assert(err == nil && name == "alice", "expect alice, got %q, err %v", name, err)
+	bob := auth.WithToken(context.Background(), "t2")
+	for _, method := range []string{"Name", "Missing"} {
+		err = client.Call(bob, "Me", method, 0, &name)
+		_assert(status.Code(err) == codes.PermissionDenied, "expect PermissionDenied for Me.%s, got %v", method, err)
+	}
+
+	policy.Set(&acl.Policy{DryRun: true})
+	err = client.Call(bob, "Me", "Name", 0, &name)
+	_assert(err == nil && name == "bob", "dry run should allow bob, got %q, err %v", name, err)
+}
@@ -3,12 +3,14 @@ package myGoRPC
 import (
 	"bufio"
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"myGoRPC/codec"
+	"myGoRPC/codes"
+	"myGoRPC/metadata"
+	"myGoRPC/status"
 	"net"
 	"net/http"
 	"strings"
@@ -22,13 +24,15 @@ Call
 封装 rpc call 的信息，Service.Method 形式调用
 */
 type Call struct {
-	Seq     uint64
-	Service string
-	Method  string
-	Args    interface{}
-	Reply   interface{}
-	Error   error
-	Done    chan *Call
+	Seq      uint64
+	Service  string
+	Method   string
+	Metadata metadata.MD // 随 header 发送给服务端
+	Deadline time.Time   // 发送时的剩余时间随 header 发送给服务端（见 timeoutOf），零值表示没有截止时间
+	Args     interface{}
+	Reply    interface{}
+	Error    error
+	Done     chan *Call
 }
 
 func (call *Call) done() {
@@ -36,15 +40,18 @@ func (call *Call) done() {
 }
 
 type Client struct {
-	cc       codec.Codec      // 消息的编解码器，序列化请求，以及反序列化响应
-	option   *Option     // 编解码方式
-	sending  sync.Mutex       // 保证请求的有序发送，防止出现多个请求报文混淆
-	header   codec.Header     // 每个请求的消息头
-	mu       sync.Mutex       // 保护以下
-	seq      uint64           // 每个请求拥有唯一编号
-	pending  map[uint64]*Call // 存储未处理完的请求，键是编号
-	closing  bool             // 用户主动关闭的；值置为 true，则表示 Client 处于不可用的状态
-	shutdown bool             // 一般有错误发生；值置为 true，则表示 Client 处于不可用的状态
+	cc       codec.Codec        // 消息的编解码器，序列化请求，以及反序列化响应
+	option   *Option            // 编解码方式
+	sending  sync.Mutex         // 保证请求的有序发送，防止出现多个请求报文混淆
+	header   codec.Header       // 每个请求的消息头
+	mu       sync.Mutex         // 保护以下
+	seq      uint64             // 每个请求拥有唯一编号
+	pending  map[uint64]*Call   // 存储未处理完的请求，键是编号
+	streams  map[uint64]*Stream // 正在进行的流，与 pending 共用编号
+	closing  bool               // 用户主动关闭的；值置为 true，则表示 Client 处于不可用的状态
+	shutdown bool               // 一般有错误发生；值置为 true，则表示 Client 处于不可用的状态
+	goAway   bool               // 服务端正在关闭（codec.KindGoAway）；不再发送新的请求，已发送的请求仍会收到回复
+	draining bool               // 见 CloseIdle
 }
 
 // 确保实现
@@ -69,7 +76,40 @@ IsAvailable
 func (client *Client) IsAvailable() bool {
 	client.mu.Lock()
 	defer client.mu.Unlock()
-	return !client.shutdown && !client.closing
+	return !client.shutdown && !client.closing && !client.goAway && !client.draining
+}
+
+/*
+CloseIdle
+不再发送新的请求，已发送的调用、流全部完成后关闭连接；连接已经出错时立即关闭。
+用于收到 GoAway 的 Client：服务端仍在处理已发送的请求，立即 Close 会使它们失败
+*/
+func (client *Client) CloseIdle() {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	client.draining = true
+	client.closeIfIdleLocked()
+}
+
+/*
+closeIfIdle
+CloseIdle 之后没有进行中的调用、流时关闭连接；
+receive 在处理完一条消息之后检查，避免关闭时回复的 body 还没有读出
+*/
+func (client *Client) closeIfIdle() {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	client.closeIfIdleLocked()
+}
+
+func (client *Client) closeIfIdleLocked() {
+	if !client.draining || client.closing {
+		return
+	}
+	if client.shutdown || len(client.pending) == 0 && len(client.streams) == 0 {
+		client.closing = true
+		_ = client.cc.Close()
+	}
 }
 
 /*
@@ -79,7 +119,7 @@ registerCall
 func (client *Client) registerCall(call *Call) (seq uint64, err error) {
 	client.mu.Lock()
 	defer client.mu.Unlock()
-	if client.closing || client.shutdown {
+	if client.closing || client.shutdown || client.goAway || client.draining {
 		return 0, ErrShutdown
 	}
 	call.Seq = client.seq
@@ -114,26 +154,63 @@ func (client *Client) terminateCalls(err error) {
 		call.Error = err
 		call.done()
 	}
+	for seq, s := range client.streams {
+		delete(client.streams, seq)
+		go s.finish(err)
+	}
 }
 
 /*
 NewClient
 
-创建 Client 实例；  完成协议交换；  创建子协程调用 receive 接受响应
+创建 Client 实例；  完成协议交换（握手）；  创建子协程调用 receive 接受响应
+
+只向服务端提供本地支持的 Codec 与压缩算法，握手完成后使用协商的结果；
+opt.LegacyHandshake 为 true 时使用旧版 JSON Option，用于连接尚未升级的服务端
 */
 func NewClient(conn net.Conn, opt *Option) (*Client, error) {
-	f := codec.NewCodecFuncMap[opt.CodecType]
-	if f == nil {
+	offer := *opt
+	if len(opt.CodecTypes) > 0 {
+		offer.CodecTypes = make([]codec.Type, 0, len(opt.CodecTypes))
+		for _, typ := range opt.CodecTypes {
+			if codec.Get(typ) != nil {
+				offer.CodecTypes = append(offer.CodecTypes, typ)
+			}
+		}
+		if len(offer.CodecTypes) == 0 {
+			err := fmt.Errorf("no registered codec in %v", opt.CodecTypes)
+			log.Println("rpc client: codec err: ", err)
+			return nil, err
+		}
+	} else if codec.Get(opt.CodecType) == nil {
 		err := fmt.Errorf("invalid codec type %s ", opt.CodecType)
 		log.Println("rpc client: codec err: ", err)
 		return nil, err
 	}
-	if err := json.NewEncoder(conn).Encode(opt); err != nil {
-		log.Println("rpc client: options error: ", err)
+	if codec.GetCompressor(opt.Compress) == nil {
+		offer.Compress = codec.CompressNone
+	}
+
+	var rwc io.ReadWriteCloser = conn
+	var err error
+	if offer.LegacyHandshake {
+		rwc, err = legacyClientHandshake(conn, &offer)
+	} else {
+		err = clientHandshake(conn, &offer)
+	}
+	if err != nil {
+		log.Println("rpc client: handshake error: ", err)
+		_ = conn.Close()
+		return nil, err
+	}
+	f := offer.newCodecFunc(codec.Limits{})
+	if f == nil {
+		err = fmt.Errorf("negotiated unsupported codec %q or compression %q", offer.CodecType, offer.Compress)
+		log.Println("rpc client: handshake error: ", err)
 		_ = conn.Close()
 		return nil, err
 	}
-	return newClientCodec(f(conn), opt), nil
+	return newClientCodec(f(rwc), &offer), nil
 }
 
 func newClientCodec(cc codec.Codec, opt *Option) *Client {
@@ -142,6 +219,7 @@ func newClientCodec(cc codec.Codec, opt *Option) *Client {
 		cc:      cc,
 		option:  opt,
 		pending: make(map[uint64]*Call),
+		streams: make(map[uint64]*Stream),
 	}
 	go client.receive()
 	return client
@@ -167,6 +245,8 @@ func parseOptions(opts ...*Option) (*Option, error) {
 	if opt.CodecType == "" {
 		opt.CodecType = DefaultOption.CodecType
 	}
+	// 与 DefaultOption 一致，默认分帧
+	opt.Framing = !opt.Unframed
 	return opt, nil
 }
 
@@ -187,7 +267,7 @@ func dialTimeout(f newClientFunc, network, address string, opts ...*Option) (cli
 	if err != nil {
 		return nil, err
 	}
-	conn, err := net.DialTimeout(network, address, opt.ConnectTimeout)
+	conn, err := dialConn(network, address, opt)
 	if err != nil {
 		return nil, err
 	}
@@ -234,13 +314,31 @@ func Dial(network, address string, opts ...*Option) (client *Client, err error)
 - call 不存在，可能是请求没有发送完整，或者因为其他原因被取消，但是服务端仍旧处理了。
 - call 存在，但服务端处理出错，即 h.Error 不为空。
 - call 存在，服务端处理正常，那么需要从 body 中读取 Reply 的值。
+
+此外，服务端关闭前发送 codec.KindGoAway，之后 Client 不可用（IsAvailable 返回 false），但仍接收已发送请求的回复。
 */
 func (client *Client) receive() {
 	var err error
 	for err == nil {
+		client.closeIfIdle()
 		var header codec.Header
 		if err = client.cc.ReadHeader(&header); err != nil {
-			break
+			if !codec.IsMessageError(err) {
+				break
+			}
+			// header 已完整读出（例如 Metadata 超出限制），只影响这一次调用
+			header.Error, err = err.Error(), nil
+		}
+		if header.Kind == codec.KindStreamMsg || header.Kind == codec.KindStreamEnd || header.Kind == codec.KindStreamWindow {
+			err = client.receiveStream(&header)
+			continue
+		}
+		if header.Kind == codec.KindGoAway {
+			client.mu.Lock()
+			client.goAway = true
+			client.mu.Unlock()
+			err = client.cc.ReadBody(nil)
+			continue
 		}
 		call := client.removeCall(header.Seq)
 		switch {
@@ -248,9 +346,9 @@ func (client *Client) receive() {
 			// 有错误出现，call 已经被清除
 			// cc.ReadBody 调用 gob.Decode，读入 nil，数据会被丢弃
 			err = client.cc.ReadBody(nil)
-		case header.Error != "":
+		case headerError(&header) != nil:
 			// 服务端处理出错
-			call.Error = fmt.Errorf(header.Error)
+			call.Error = headerError(&header)
 			err = client.cc.ReadBody(nil)
 			call.done()
 		default:
@@ -258,6 +356,10 @@ func (client *Client) receive() {
 			err = client.cc.ReadBody(call.Reply)
 			if err != nil {
 				call.Error = errors.New("reading body " + err.Error())
+				// 分帧传输时只影响这一次调用
+				if codec.IsMessageError(err) {
+					err = nil
+				}
 			}
 			call.done()
 		}
@@ -283,6 +385,8 @@ func (client *Client) send(call *Call) {
 	client.header.Method = call.Method
 	client.header.Seq = seq
 	client.header.Error = ""
+	client.header.Metadata = call.Metadata
+	client.header.Timeout = timeoutOf(call.Deadline)
 
 	// encode and send the request
 	if err = client.cc.Write(&client.header, call.Args); err != nil {
@@ -292,11 +396,46 @@ func (client *Client) send(call *Call) {
 			call.Error = err
 			call.done()
 		}
+		client.closeIfIdle()
+	}
+}
+
+/*
+sendControl
+发送 body 为空的控制消息，例如通知服务端取消 seq 对应的调用（codec.KindCancel），服务端不会再回复；
+发送失败时连接已被关闭，由 receive 处理
+*/
+func (client *Client) sendControl(h codec.Header) {
+	client.sending.Lock()
+	defer client.sending.Unlock()
+
+	if err := client.cc.Write(&h, invalidRequest); err != nil {
+		log.Println("rpc client: send control message error: ", err)
+	}
+}
+
+/*
+headerError
+还原服务端回复的错误，没有错误时返回 nil；旧版本的服务端没有错误码，视为 codes.Unknown
+*/
+func headerError(h *codec.Header) error {
+	if h.Error == "" && h.Code == uint32(codes.OK) {
+		return nil
 	}
+	code := codes.Code(h.Code)
+	if code == codes.OK {
+		code = codes.Unknown
+	}
+	return status.New(code, h.Error).WithDetails(h.Details...).Err()
 }
 
 // ----------------- Invoke func --------------
 
+/*
+Go
+异步调用，结果通过 done 通知；
+配置了 Option.Interceptors 时，在子协程中经过拦截器调用 invoke（ctx 为 context.Background()），返回的 Call 没有 Seq
+*/
 func (client *Client) Go(service, method string, args, reply interface{}, done chan *Call) *Call {
 	if done == nil {
 		done = make(chan *Call, 10)
@@ -310,6 +449,13 @@ func (client *Client) Go(service, method string, args, reply interface{}, done c
 		Reply:   reply,
 		Done:    done,
 	}
+	if len(client.option.Interceptors) > 0 {
+		go func() {
+			call.Error = client.Call(context.Background(), service, method, args, reply)
+			call.done()
+		}()
+		return call
+	}
 	client.send(call)
 	return call
 }
@@ -317,19 +463,90 @@ func (client *Client) Go(service, method string, args, reply interface{}, done c
 /*
 Call
 
-使用context包，超时处理
+经过 Option.Interceptors 调用 invoke
 */
 func (client *Client) Call(ctx context.Context, service, method string, args, reply interface{}) error {
-	call := client.Go(service, method, args, reply, make(chan *Call, 1))
+	return client.intercept(ctx, service, method, args, reply, client.invoke)
+}
+
+/*
+Notify
+单向调用：请求发出后立即返回，不注册到 pending，也不会收到回复，方法的 reply 被丢弃；
+服务端的错误（方法不存在、方法返回错误等）只记录在服务端的日志中，返回的错误只表示请求没有发出。
+同样经过 Option.Interceptors，此时 reply 为 nil；ctx 的 Metadata、截止时间随请求发送
+*/
+func (client *Client) Notify(ctx context.Context, service, method string, args interface{}) error {
+	return client.intercept(ctx, service, method, args, nil, client.notify)
+}
+
+func (client *Client) notify(ctx context.Context, service, method string, args, _ interface{}) error {
+	h := codec.Header{Service: service, Method: method, Kind: codec.KindNotify}
+	if md, ok := metadata.FromOutgoingContext(ctx); ok {
+		h.Metadata = md
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		h.Timeout = timeoutOf(deadline)
+	}
+	client.mu.Lock()
+	unavailable := client.closing || client.shutdown || client.goAway || client.draining
+	client.mu.Unlock()
+	if unavailable {
+		return ErrShutdown
+	}
+	client.sending.Lock()
+	defer client.sending.Unlock()
+	return client.cc.Write(&h, args)
+}
+
+/*
+timeoutOf
+截止时间换算为 header.Timeout：发送时的剩余时间，已经过期时为 -1。
+只发送相对时间，服务端以收到请求的时间重建截止时间，不依赖两端的时钟同步
+*/
+func timeoutOf(deadline time.Time) int64 {
+	if deadline.IsZero() {
+		return 0
+	}
+	if d := time.Until(deadline); d > 0 {
+		return int64(d)
+	}
+	return -1
+}
+
+/*
+invoke
+
+使用context包，超时处理；
+ctx 中由 metadata.NewOutgoingContext 设置的 MD 以及 ctx 的截止时间随请求 header 发送
+
+ctx 结束时如果调用仍未完成，向服务端发送取消消息，服务端正在执行的方法随之被取消
+*/
+func (client *Client) invoke(ctx context.Context, service, method string, args, reply interface{}) error {
+	call := &Call{
+		Service: service,
+		Method:  method,
+		Args:    args,
+		Reply:   reply,
+		Done:    make(chan *Call, 1),
+	}
+	if md, ok := metadata.FromOutgoingContext(ctx); ok {
+		call.Metadata = md
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		call.Deadline = deadline
+	}
+	client.send(call)
 
 	select {
 	case <-ctx.Done():
-		client.removeCall(call.Seq)
-		return errors.New("rpc client: call failed: " + ctx.Err().Error())
+		if client.removeCall(call.Seq) != nil {
+			client.sendControl(codec.Header{Kind: codec.KindCancel, Seq: call.Seq})
+			client.closeIfIdle()
+		}
+		return status.Error(status.FromContextError(ctx.Err()).Code(), "rpc client: call failed: "+ctx.Err().Error())
 	case call := <-call.Done:
 		return call.Error
 	}
-	return call.Error
 }
 
 // 客户端发起 HTTP CONNECT 链接
@@ -355,8 +572,9 @@ func DialHTTP(network, address string, opts ...*Option) (*Client, error) {
 /*
 XDial 简化调用，统一入口
 根据第一个参数 rpcAddr 判定 protocol@addr
-eg: http@10.0.0.1:7000, tcp@10.0.0.1:9999, unix@/tmp/myGoRPC.sock
- */
+eg: http@10.0.0.1:7000, tcp@10.0.0.1:9999, unix@/tmp/myGoRPC.sock, tls@10.0.0.1:9443
+tls 使用 Option.TLSConfig，为 nil 时使用系统的根证书验证服务端
+*/
 func XDial(rpcAddr string, opts ...*Option) (*Client, error) {
 	parts := strings.Split(rpcAddr, "@")
 	if len(parts) != 2 {
@@ -366,10 +584,14 @@ func XDial(rpcAddr string, opts ...*Option) (*Client, error) {
 	switch protocol {
 	case "http":
 		return DialHTTP("tcp", addr, opts...)
+	case "tls":
+		opt, err := parseOptions(opts...)
+		if err != nil {
+			return nil, err
+		}
+		return DialTLS("tcp", addr, opt.TLSConfig, opt)
 	default:
 		// tcp, unix or other transport protocol
 		return Dial(protocol, addr, opts...)
 	}
 }
-
-
@@ -1,14 +1,20 @@
 package myGoRPC
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"myGoRPC/codec"
+	"myGoRPC/metadata"
 	"net"
 	"os"
 	"runtime"
 	"strings"
 	"testing"
 	"time"
+
+	"google.golang.org/protobuf/types/known/wrapperspb"
 )
 
 func _assert(condition bool, msg string, v ...interface{}) {
@@ -50,11 +56,55 @@ func TestClient_dialTimeout(t *testing.T) {
 
 type Bar int
 
+type Args struct{ Num1, Num2 int }
+
 func (b Bar) Timeout(argv int, reply *int) error {
 	time.Sleep(time.Second * 2)
 	return nil
 }
 
+func (b Bar) Sum(args Args, reply *int) error {
+	*reply = args.Num1 + args.Num2
+	return nil
+}
+
+func (b Bar) Repeat(n int, reply *string) error {
+	*reply = strings.Repeat("myGoRPC ", n)
+	return nil
+}
+
+// Meta 返回请求 Metadata 中 key 对应的值
+func (b Bar) Meta(ctx context.Context, key string, reply *string) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	*reply = md.Get(key)
+	return nil
+}
+
+// Wait 阻塞直到 ctx 被取消，通过 canceled 报告取消原因
+var canceled = make(chan error, 1)
+
+func (b Bar) Wait(ctx context.Context, n int, reply *int) error {
+	<-ctx.Done()
+	canceled <- ctx.Err()
+	return ctx.Err()
+}
+
+// Note 通过 notes 报告收到的单向调用，reply 被丢弃
+var notes = make(chan string, 1)
+
+func (b Bar) Note(ctx context.Context, msg string, reply *int) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	notes <- msg + md.Get("tenant")
+	*reply = len(msg)
+	return nil
+}
+
+// Chan 的返回值无法被任何 Codec 编码
+func (b Bar) Chan(n int, reply *chan int) error {
+	*reply = make(chan int, n)
+	return nil
+}
+
 func startServer(addr chan string) {
 	var b Bar
 	testServer := NewServer()
@@ -73,7 +123,8 @@ func TestClient_Call(t *testing.T) {
 	time.Sleep(time.Second)
 	t.Run("client timeout", func(t *testing.T) {
 		client, _ := Dial("tcp", addr)
-		ctx, _ := context.WithTimeout(context.Background(), time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
 		var reply int
 		err := client.Call(ctx, "Bar", "Timeout", 1, &reply)
 		_assert(err != nil && strings.Contains(err.Error(), ctx.Err().Error()), "expect a timeout error")
@@ -88,22 +139,381 @@ func TestClient_Call(t *testing.T) {
 	})
 }
 
+/*
+测试 JSON 编解码。
+header 与 body 经过 Client.Call 往返，错误信息通过 header.Error 带回客户端
+*/
+func TestClient_CallJson(t *testing.T) {
+	t.Parallel()
+	addrCh := make(chan string)
+	go startServer(addrCh)
+	addr := <-addrCh
+
+	client, err := Dial("tcp", addr, &Option{CodecType: codec.JsonType})
+	_assert(err == nil, "failed to dial with json codec: %v", err)
+	defer func() { _ = client.Close() }()
+
+	t.Run("reply", func(t *testing.T) {
+		var reply int
+		err := client.Call(context.Background(), "Bar", "Sum", Args{Num1: 1, Num2: 2}, &reply)
+		_assert(err == nil && reply == 3, "expect 3, got %d, err %v", reply, err)
+	})
+	t.Run("error", func(t *testing.T) {
+		var reply int
+		err := client.Call(context.Background(), "Bar", "Unknown", Args{}, &reply)
+		_assert(err != nil && strings.Contains(err.Error(), "can't find method"), "expect a method error, got %v", err)
+	})
+}
+
+/*
+测试 protobuf 编解码。
+参数与返回值均为 proto.Message，经过 Server/Client 完整往返
+*/
+type Echo int
+
+func (e Echo) Upper(args *wrapperspb.StringValue, reply *wrapperspb.StringValue) error {
+	reply.Value = strings.ToUpper(args.GetValue())
+	return nil
+}
+
+func TestClient_CallProtobuf(t *testing.T) {
+	t.Parallel()
+	var e Echo
+	server := NewServer()
+	_ = server.Register(&e)
+	l, _ := net.Listen("tcp", ":0")
+	go server.Accept(l)
+
+	client, err := Dial("tcp", l.Addr().String(), &Option{CodecType: codec.ProtobufType})
+	_assert(err == nil, "failed to dial with protobuf codec: %v", err)
+	defer func() { _ = client.Close() }()
+
+	reply := new(wrapperspb.StringValue)
+	err = client.Call(context.Background(), "Echo", "Upper", wrapperspb.String("rpc"), reply)
+	_assert(err == nil && reply.GetValue() == "RPC", "expect RPC, got %q, err %v", reply.GetValue(), err)
+
+	err = client.Call(context.Background(), "Echo", "Lower", wrapperspb.String("rpc"), reply)
+	_assert(err != nil && strings.Contains(err.Error(), "can't find method"), "expect a method error, got %v", err)
+}
+
+/*
+测试 Codec 协商。
+客户端按偏好给出候选列表，服务端选择第一个支持的 Codec；没有可用 Codec 时服务端回复错误并关闭连接
+*/
+func TestClient_Negotiate(t *testing.T) {
+	t.Parallel()
+	addrCh := make(chan string)
+	go startServer(addrCh)
+	addr := <-addrCh
+
+	t.Run("pick first supported", func(t *testing.T) {
+		client, err := Dial("tcp", addr, &Option{CodecTypes: []codec.Type{"application/unknown", codec.JsonType, codec.GobType}})
+		_assert(err == nil, "failed to negotiate: %v", err)
+		defer func() { _ = client.Close() }()
+		_assert(client.option.CodecType == codec.JsonType, "expect json, got %s", client.option.CodecType)
+		var reply int
+		err = client.Call(context.Background(), "Bar", "Sum", Args{Num1: 3, Num2: 4}, &reply)
+		_assert(err == nil && reply == 7, "expect 7, got %d, err %v", reply, err)
+	})
+	t.Run("no supported codec", func(t *testing.T) {
+		conn, err := net.Dial("tcp", addr)
+		_assert(err == nil, "failed to dial: %v", err)
+		defer func() { _ = conn.Close() }()
+		opt := &Option{RpcNumber: RpcNumber, CodecTypes: []codec.Type{"application/unknown"}}
+		_assert(json.NewEncoder(conn).Encode(opt) == nil, "failed to send option")
+		var reply negotiation
+		err = json.NewDecoder(conn).Decode(&reply)
+		_assert(err == nil && reply.Error != "" && reply.CodecType == "", "expect a negotiation error, got %+v %v", reply, err)
+	})
+}
+
+/*
+测试压缩协商。
+服务端支持的压缩算法被采用，大回复经过压缩往返；不支持的算法退化为不压缩
+*/
+func TestClient_Compress(t *testing.T) {
+	t.Parallel()
+	addrCh := make(chan string)
+	go startServer(addrCh)
+	addr := <-addrCh
+
+	t.Run("zstd", func(t *testing.T) {
+		client, err := Dial("tcp", addr, &Option{Compress: codec.CompressZstd, CompressThreshold: 128})
+		_assert(err == nil, "failed to negotiate compression: %v", err)
+		defer func() { _ = client.Close() }()
+		_assert(client.option.Compress == codec.CompressZstd, "expect zstd, got %q", client.option.Compress)
+		for _, n := range []int{1, 4096} {
+			var reply string
+			err = client.Call(context.Background(), "Bar", "Repeat", n, &reply)
+			_assert(err == nil && reply == strings.Repeat("myGoRPC ", n), "repeat %d mismatch, err %v", n, err)
+		}
+	})
+	t.Run("unsupported", func(t *testing.T) {
+		client, err := Dial("tcp", addr, &Option{Compress: "lz4"})
+		_assert(err == nil, "failed to dial: %v", err)
+		defer func() { _ = client.Close() }()
+		_assert(client.option.Compress == codec.CompressNone, "expect no compression, got %q", client.option.Compress)
+		var reply int
+		err = client.Call(context.Background(), "Bar", "Sum", Args{Num1: 1, Num2: 1}, &reply)
+		_assert(err == nil && reply == 2, "expect 2, got %d, err %v", reply, err)
+	})
+}
+
+/*
+测试握手。
+二进制握手与旧版 JSON Option 都能建立连接；版本、Codec 不匹配时服务端回复明确的错误
+*/
+func TestClient_Handshake(t *testing.T) {
+	t.Parallel()
+	addrCh := make(chan string)
+	go startServer(addrCh)
+	addr := <-addrCh
+
+	call := func(client *Client) {
+		var reply int
+		err := client.Call(context.Background(), "Bar", "Sum", Args{Num1: 2, Num2: 3}, &reply)
+		_assert(err == nil && reply == 5, "expect 5, got %d, err %v", reply, err)
+	}
+	t.Run("binary", func(t *testing.T) {
+		client, err := Dial("tcp", addr, &Option{CodecType: codec.MsgpackType, HandleTimeout: time.Second})
+		_assert(err == nil, "failed to dial: %v", err)
+		defer func() { _ = client.Close() }()
+		_assert(client.option.CodecType == codec.MsgpackType, "expect msgpack, got %s", client.option.CodecType)
+		call(client)
+	})
+	t.Run("legacy json", func(t *testing.T) {
+		client, err := Dial("tcp", addr, &Option{LegacyHandshake: true})
+		_assert(err == nil, "failed to dial: %v", err)
+		defer func() { _ = client.Close() }()
+		call(client)
+	})
+	t.Run("legacy json negotiate", func(t *testing.T) {
+		client, err := Dial("tcp", addr, &Option{LegacyHandshake: true, CodecTypes: []codec.Type{codec.JsonType}})
+		_assert(err == nil && client.option.CodecType == codec.JsonType, "failed to negotiate: %v", err)
+		defer func() { _ = client.Close() }()
+		call(client)
+	})
+
+	rawHello := func(b []byte) *ack {
+		conn, err := net.Dial("tcp", addr)
+		_assert(err == nil, "failed to dial: %v", err)
+		defer func() { _ = conn.Close() }()
+		_, _ = conn.Write(b)
+		a, err := readAck(conn)
+		_assert(err == nil, "failed to read ack: %v", err)
+		return a
+	}
+	t.Run("bad version", func(t *testing.T) {
+		var buf bytes.Buffer
+		_ = writeHello(&buf, DefaultOption)
+		b := buf.Bytes()
+		b[4] = HandshakeVersion + 1
+		a := rawHello(b)
+		_assert(a.Status == handshakeBadVersion && a.Version == HandshakeVersion, "expect a version error, got %+v", a)
+	})
+	t.Run("bad codec", func(t *testing.T) {
+		var buf bytes.Buffer
+		_ = writeHello(&buf, &Option{CodecTypes: []codec.Type{"application/unknown"}})
+		a := rawHello(buf.Bytes())
+		_assert(a.Status == handshakeBadCodec && strings.Contains(a.Message, "no acceptable codec"), "expect a codec error, got %+v", a)
+	})
+}
+
+/*
+测试分帧传输。
+自定义 Option 同样默认分帧，Unframed 时不分帧；
+参数无法解码、返回值无法编码、方法不存在时，只有这一次调用失败，同一连接上的后续调用不受影响
+*/
+func TestClient_Framing(t *testing.T) {
+	t.Parallel()
+	addrCh := make(chan string)
+	go startServer(addrCh)
+	addr := <-addrCh
+
+	unframed, err := Dial("tcp", addr, &Option{Unframed: true})
+	_assert(err == nil && !unframed.option.Framing, "expect no framing, err %v", err)
+	_ = unframed.Close()
+
+	for _, typ := range []codec.Type{codec.GobType, codec.JsonType} {
+		t.Run(string(typ), func(t *testing.T) {
+			client, err := Dial("tcp", addr, &Option{CodecType: typ, ConnectTimeout: time.Second})
+			_assert(err == nil && client.option.Framing, "failed to negotiate framing: %v", err)
+			defer func() { _ = client.Close() }()
+
+			var reply int
+			err = client.Call(context.Background(), "Bar", "Sum", "not args", &reply)
+			_assert(err != nil, "expect a decode error")
+			err = client.Call(context.Background(), "Bar", "Unknown", Args{}, &reply)
+			_assert(err != nil && strings.Contains(err.Error(), "can't find method"), "expect a method error, got %v", err)
+			var ch chan int
+			err = client.Call(context.Background(), "Bar", "Chan", 1, &ch)
+			_assert(err != nil && strings.Contains(err.Error(), "encode reply"), "expect an encode error, got %v", err)
+
+			err = client.Call(context.Background(), "Bar", "Sum", Args{Num1: 1, Num2: 2}, &reply)
+			_assert(err == nil && reply == 3 && client.IsAvailable(), "expect 3 on the same connection, got %d, err %v", reply, err)
+		})
+	}
+}
+
+/*
+测试 Metadata。
+超出大小限制的 Metadata 只导致这一次调用失败
+*/
+func TestClient_Metadata(t *testing.T) {
+	t.Parallel()
+	addrCh := make(chan string)
+	go startServer(addrCh)
+	addr := <-addrCh
+
+	client, err := Dial("tcp", addr)
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+
+	var reply int
+	ctx := metadata.NewOutgoingContext(context.Background(), metadata.Pairs("big", strings.Repeat("x", codec.MaxMetadataSize)))
+	err = client.Call(ctx, "Bar", "Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err != nil && strings.Contains(err.Error(), "metadata too large"), "expect a metadata error, got %v", err)
+
+	ctx = metadata.AppendToOutgoingContext(context.Background(), "trace-id", "abc")
+	err = client.Call(ctx, "Bar", "Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3, "expect 3, got %d, err %v", reply, err)
+}
+
+/*
+测试带 context.Context 的方法。
+方法能读取请求的 Metadata；服务端处理超时后 ctx 被取消
+*/
+func TestClient_Context(t *testing.T) {
+	t.Parallel()
+	addrCh := make(chan string)
+	go startServer(addrCh)
+	addr := <-addrCh
+
+	client, err := Dial("tcp", addr, &Option{HandleTimeout: time.Millisecond * 100})
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+
+	var reply string
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "tenant", "t1")
+	err = client.Call(ctx, "Bar", "Meta", "tenant", &reply)
+	_assert(err == nil && reply == "t1", "expect t1, got %q, err %v", reply, err)
+
+	var n int
+	err = client.Call(context.Background(), "Bar", "Wait", 1, &n)
+	_assert(err != nil && strings.Contains(err.Error(), "handle timeout"), "expect a timeout error, got %v", err)
+	select {
+	case err = <-canceled:
+		_assert(err == context.DeadlineExceeded, "expect deadline exceeded, got %v", err)
+	case <-time.After(time.Second):
+		t.Fatal("handler context is not canceled")
+	}
+}
+
+/*
+测试客户端拦截器。
+按配置顺序执行，Call 与 Go 都会经过；可以注入 Metadata，也可以不发送请求直接返回（mock）
+*/
+func TestClient_Interceptors(t *testing.T) {
+	t.Parallel()
+	addrCh := make(chan string)
+	go startServer(addrCh)
+	addr := <-addrCh
+
+	var calls []string
+	client, err := Dial("tcp", addr, &Option{Interceptors: []ClientInterceptor{
+		func(ctx context.Context, service, method string, args, reply interface{}, invoker Invoker) error {
+			calls = append(calls, service+"."+method)
+			return invoker(metadata.AppendToOutgoingContext(ctx, "tenant", "t2"), service, method, args, reply)
+		},
+		func(ctx context.Context, service, method string, args, reply interface{}, invoker Invoker) error {
+			if method == "Mock" {
+				*reply.(*string) = "mocked"
+				return nil
+			}
+			return invoker(ctx, service, method, args, reply)
+		},
+	}})
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+
+	var reply string
+	err = client.Call(context.Background(), "Bar", "Meta", "tenant", &reply)
+	_assert(err == nil && reply == "t2", "expect t2, got %q, err %v", reply, err)
+
+	call := <-client.Go("Bar", "Mock", 0, &reply, nil).Done
+	_assert(call.Error == nil && reply == "mocked", "expect mocked, got %q, err %v", reply, call.Error)
+	_assert(strings.Join(calls, ",") == "Bar.Meta,Bar.Mock", "wrong intercepted calls: %v", calls)
+}
+
+/*
+测试单向调用。
+不注册到 pending、不等待回复；服务端的错误不会回复，连接上后续的调用不受影响
+*/
+func TestClient_Notify(t *testing.T) {
+	t.Parallel()
+	addrCh := make(chan string)
+	go startServer(addrCh)
+	addr := <-addrCh
+	client, err := Dial("tcp", addr)
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "tenant", "t3")
+	_assert(client.Notify(ctx, "Bar", "Note", "hello ") == nil, "failed to notify")
+	select {
+	case note := <-notes:
+		_assert(note == "hello t3", "expect hello t3, got %q", note)
+	case <-time.After(time.Second):
+		t.Fatal("notification is not handled")
+	}
+	client.mu.Lock()
+	pending := len(client.pending)
+	client.mu.Unlock()
+	_assert(pending == 0, "notification should not be pending")
+
+	_assert(client.Notify(ctx, "Bar", "Missing", 1) == nil, "notify reports server errors only in the server log")
+	var reply int
+	err = client.Call(context.Background(), "Bar", "Sum", Args{Num1: 1, Num2: 2}, &reply)
+	_assert(err == nil && reply == 3, "call after notifications failed: %v", err)
+}
+
 func TestXDail(t *testing.T) {
 	if runtime.GOOS == "darwin" {
-		ch := make(chan struct{})
 		addr := "/tmp/myGoRPC.sock"
+		_ = os.Remove(addr)
+		l, err := net.Listen("unix", addr)
+		if err != nil {
+			t.Fatal("failed to listen unix socket")
+		}
 		go func() {
-			_ = os.Remove(addr)
-			l, err := net.Listen("unix", addr)
-			if err != nil {
-				t.Fatal("failed to listen unix socket")
-			}
-			ch <- struct{}{}
 			testServer := NewServer()
 			testServer.Accept(l)
 		}()
-		<-ch
-		_, err := XDial("unix@" + addr)
+		_, err = XDial("unix@" + addr)
 		_assert(err == nil, "failed to connect unix socket")
 	}
 }
+
+/*
+测试 CloseIdle。
+收到 GoAway 后调用 CloseIdle，服务端仍在处理的调用正常完成，之后连接被关闭
+*/
+func TestClient_CloseIdle(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	client, err := Dial("tcp", startSleepServerWith(t, server))
+	_assert(err == nil, "failed to dial: %v", err)
+	call := client.Go("Sleep", "Ignore", time.Millisecond*200, new(int), nil)
+	time.Sleep(time.Millisecond * 50)
+	go func() { _ = server.Shutdown(context.Background()) }()
+	for client.IsAvailable() {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	client.CloseIdle()
+	err = client.Call(context.Background(), "Sleep", "Ignore", time.Duration(0), new(int))
+	_assert(err == ErrShutdown, "expect ErrShutdown after CloseIdle, got %v", err)
+	<-call.Done
+	_assert(call.Error == nil, "the pending call should succeed, got %v", call.Error)
+	_assert(client.Close() == ErrShutdown, "expect the client to be closed after its calls finish")
+}
@@ -1,6 +1,11 @@
 package codec
 
-import "io"
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
 
 /*
 Header
@@ -8,10 +13,61 @@ Header
 定义客户端发送的请求头信息
 */
 type Header struct {
-	Service string // 服务名
-	Method  string // 方法名
-	Seq     uint64 // 请求序列号
-	Error   string // 错误信息
+	Service  string            // 服务名
+	Method   string            // 方法名
+	Seq      uint64            // 请求序列号
+	Error    string            // 错误信息
+	Metadata map[string]string // 请求范围的键值对，例如鉴权 token、trace ID、租户 ID
+	Kind     Kind              // 消息类型，零值为普通的请求、回复
+	Timeout  int64             // 调用方 context 的剩余时间（纳秒），0 表示没有截止时间，负数表示发送时已经过期
+	Code     uint32            // 错误码（codes.Code），Error 非空而 Code 为 0 时视为 codes.Unknown
+	Details  []string          // 错误的附加信息，见 status.Status
+	Window   uint32            // 流量控制：KindStream 时为初始窗口，KindStreamWindow 时为新增的额度
+}
+
+/*
+Kind
+区分 header 之后的消息用途，控制消息同样带有 body（通常为空），保证数据流不会错位
+*/
+type Kind uint8
+
+const (
+	KindRequest Kind = iota // 普通的请求、回复
+	KindCancel              // 客户端放弃 Seq 对应的调用，服务端取消正在执行的方法，不再回复
+	KindGoAway              // 服务端正在关闭，客户端不再发送新的请求，已发送的请求仍会回复
+
+	// 流式调用，同一连接上按 Seq 与普通调用复用
+	KindStream       // 客户端打开流，body 为参数（客户端流没有参数）
+	KindStreamMsg    // 流中的一条消息，body 为消息
+	KindStreamEnd    // 服务端发送时为流结束，Code、Error、Details 为结果；客户端发送时为结束发送；body 为空
+	KindStreamWindow // 接收方处理了消息，向发送方增加 Window 条消息的额度，body 为空
+
+	KindNotify // 单向调用，body 为参数，服务端执行方法但不回复
+)
+
+/*
+Metadata 的大小限制，ReadHeader 解析出 header 后检查，
+超出时返回包装了 ErrMetadataTooLarge 的 MessageError：header 其余字段有效，body 仍需读出
+*/
+var (
+	MaxMetadataEntries = 64
+	MaxMetadataSize    = 8 << 10 // 所有 key、value 的总字节数
+)
+
+var ErrMetadataTooLarge = errors.New("metadata too large")
+
+func checkMetadata(h *Header) error {
+	if len(h.Metadata) > MaxMetadataEntries {
+		return &MessageError{Err: fmt.Errorf("%w: %d entries, limit %d", ErrMetadataTooLarge, len(h.Metadata), MaxMetadataEntries)}
+	}
+	size := 0
+	for k, v := range h.Metadata {
+		size += len(k) + len(v)
+	}
+	if size > MaxMetadataSize {
+		return &MessageError{Err: fmt.Errorf("%w: %d bytes, limit %d", ErrMetadataTooLarge, size, MaxMetadataSize)}
+	}
+	return nil
 }
 
 /*
@@ -22,6 +78,7 @@ io.Closer: 关闭数据流
 ReadHeader, ReadBody: 调用 gob.Decoder
 从数据流中读取下一个值，并写入（参数需要为相应类型的指针，nil 会丢弃数值）
 如果 下一个值为 EOF，返回 io.EOF error
+ReadHeader 还需要检查 Metadata 的大小限制（checkMetadata）
 
 Write: 调用 gob.Encoder
 一次性写入数据到 header body 中
@@ -43,18 +100,81 @@ type NewCodecFunc func(closer io.ReadWriteCloser) Codec
 
 /*
 Type
-定义 Codec 类型，GobType, JsonType(未实现)
+定义 Codec 类型，GobType, JsonType, ProtobufType, MsgpackType
  */
 type Type string
 
 const (
-	GobType  Type = "application/gob"
-	JsonType Type = "application/json" // not implemented
+	GobType      Type = "application/gob"
+	JsonType     Type = "application/json"
+	ProtobufType Type = "application/protobuf"
+	MsgpackType  Type = "application/msgpack"
 )
 
-var NewCodecFuncMap map[Type]NewCodecFunc
+var (
+	mu              sync.RWMutex
+	newCodecFuncMap = make(map[Type]NewCodecFunc)
+)
+
+/*
+NewCodecFuncMap
+已注册的 Codec 构造函数，由 Register 同步写入，只应读取
+
+Deprecated: 直接读写该 map 不是并发安全的，写入也不会被 Get、Negotiate 看到，使用 Register 与 Get
+*/
+var NewCodecFuncMap = make(map[Type]NewCodecFunc)
 
 func init() {
-	NewCodecFuncMap = make(map[Type]NewCodecFunc)
-	NewCodecFuncMap[GobType] = NewGobCodec
+	_ = Register(GobType, NewGobCodec)
+	_ = Register(JsonType, NewJsonCodec)
+	_ = Register(ProtobufType, NewProtobufCodec)
+	_ = Register(MsgpackType, NewMsgpackCodec)
+	_ = RegisterSerializer(GobType, gobSerializer{})
+	_ = RegisterSerializer(JsonType, jsonSerializer{})
+	_ = RegisterSerializer(ProtobufType, protobufSerializer)
+	_ = RegisterSerializer(MsgpackType, msgpackSerializer{})
+}
+
+/*
+Register
+注册 Codec 的构造函数，同一 Type 重复注册返回错误，
+通常在使用方 package 的 init 中调用
+*/
+func Register(typ Type, f NewCodecFunc) error {
+	if typ == "" || f == nil {
+		return errors.New("rpc codec: register with empty type or nil NewCodecFunc")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if _, dup := newCodecFuncMap[typ]; dup {
+		return fmt.Errorf("rpc codec: codec type %s already registered", typ)
+	}
+	newCodecFuncMap[typ] = f
+	NewCodecFuncMap[typ] = f
+	return nil
+}
+
+/*
+Get
+根据 Type 得到构造函数，未注册时返回 nil
+*/
+func Get(typ Type) NewCodecFunc {
+	mu.RLock()
+	defer mu.RUnlock()
+	return newCodecFuncMap[typ]
+}
+
+/*
+Negotiate
+按照 offers 的顺序（客户端的偏好），返回第一个已注册的 Type
+*/
+func Negotiate(offers []Type) (Type, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	for _, typ := range offers {
+		if _, ok := newCodecFuncMap[typ]; ok {
+			return typ, true
+		}
+	}
+	return "", false
 }
@@ -0,0 +1,82 @@
+package codec
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func _assert(condition bool, msg string, v ...interface{}) {
+	if !condition {
+		panic(fmt.Sprintf("assertion failed: "+msg, v...))
+	}
+}
+
+// bufferConn 以 bytes.Buffer 模拟连接，写入的数据可以被同一个实例读出
+type bufferConn struct {
+	bytes.Buffer
+}
+
+func (b *bufferConn) Close() error { return nil }
+
+var _ io.ReadWriteCloser = (*bufferConn)(nil)
+
+// unregister 撤销测试中的注册，使测试可以重复运行（-count）
+func unregister(typ Type) {
+	mu.Lock()
+	defer mu.Unlock()
+	delete(newCodecFuncMap, typ)
+	delete(NewCodecFuncMap, typ)
+}
+
+func TestRegister(t *testing.T) {
+	typ := Type("application/x-register-test")
+	_assert(Get(typ) == nil, "unregistered type should return nil")
+	_assert(Register(typ, NewGobCodec) == nil, "failed to register %s", typ)
+	t.Cleanup(func() { unregister(typ) })
+	_assert(Get(typ) != nil && NewCodecFuncMap[typ] != nil, "registered type should return its NewCodecFunc")
+	_assert(Register(typ, NewJsonCodec) != nil, "expect an error on duplicate registration")
+	_assert(Register(GobType, NewGobCodec) != nil, "built-in codec can't be replaced")
+	_assert(Register("", NewGobCodec) != nil && Register(typ+"2", nil) != nil, "expect an error on empty registration")
+
+	got, ok := Negotiate([]Type{"application/unknown", JsonType, GobType})
+	_assert(ok && got == JsonType, "expect the first supported offer, got %s", got)
+	_, ok = Negotiate([]Type{"application/unknown"})
+	_assert(!ok, "expect negotiation to fail without supported offers")
+}
+
+func TestHeader_Metadata(t *testing.T) {
+	codecs := map[string]NewCodecFunc{
+		"gob":      NewGobCodec,
+		"json":     NewJsonCodec,
+		"protobuf": NewProtobufCodec,
+		"msgpack":  NewMsgpackCodec,
+		"framed":   Framed(GobType),
+	}
+	for name, f := range codecs {
+		t.Run(name, func(t *testing.T) {
+			cc := f(new(bufferConn))
+			md := map[string]string{"trace-id": "abc", "tenant": "t1"}
+			tooMany := make(map[string]string)
+			for i := 0; i <= MaxMetadataEntries; i++ {
+				tooMany[fmt.Sprint(i)] = "v"
+			}
+			_assert(cc.Write(&Header{Service: "Foo", Seq: 1, Metadata: md}, struct{}{}) == nil, "failed to write metadata")
+			_assert(cc.Write(&Header{Service: "Foo", Seq: 2, Metadata: tooMany}, struct{}{}) == nil, "failed to write metadata")
+			_assert(cc.Write(&Header{Service: "Foo", Seq: 3}, struct{}{}) == nil, "failed to write header")
+
+			var h Header
+			_assert(cc.ReadHeader(&h) == nil && h.Seq == 1 && h.Metadata["trace-id"] == "abc" && h.Metadata["tenant"] == "t1", "metadata mismatch: %+v", h)
+			_assert(cc.ReadBody(nil) == nil, "failed to discard body")
+
+			err := cc.ReadHeader(&h)
+			_assert(IsMessageError(err) && errors.Is(err, ErrMetadataTooLarge) && h.Seq == 2, "expect ErrMetadataTooLarge, got %v", err)
+			_assert(cc.ReadBody(nil) == nil, "failed to discard body")
+
+			_assert(cc.ReadHeader(&h) == nil && h.Seq == 3 && len(h.Metadata) == 0, "header mismatch: %+v", h)
+			_assert(cc.ReadBody(nil) == nil, "failed to discard body")
+		})
+	}
+}
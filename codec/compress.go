@@ -0,0 +1,379 @@
+package codec
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+/*
+CompressType
+定义压缩算法，空字符串表示不压缩
+*/
+type CompressType string
+
+const (
+	CompressNone   CompressType = ""
+	CompressGzip   CompressType = "gzip"
+	CompressSnappy CompressType = "snappy"
+	CompressZstd   CompressType = "zstd"
+)
+
+// DefaultCompressThreshold 消息小于该字节数时不压缩
+const DefaultCompressThreshold = 1024
+
+// MaxFrameSize 压缩连接上一帧（一条完整消息）压缩前、解压后的大小上限，超出时连接不再可用，见 LimitCompressed
+var MaxFrameSize = 64 << 20
+
+/*
+Compressor
+压缩、解压一段完整的数据，实现需要并发安全
+*/
+type Compressor interface {
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+/*
+LimitDecompressor
+可选接口，解压时最多产生 max 字节，超出时返回 ErrFrameTooLarge，而不是先分配完整的数据；
+没有实现时先解压，再检查长度
+*/
+type LimitDecompressor interface {
+	DecompressLimit(data []byte, max int) ([]byte, error)
+}
+
+var compressorMap = make(map[CompressType]Compressor)
+
+func init() {
+	_ = RegisterCompressor(CompressGzip, new(gzipCompressor))
+	_ = RegisterCompressor(CompressSnappy, snappyCompressor{})
+	_ = RegisterCompressor(CompressZstd, new(zstdCompressor))
+}
+
+/*
+RegisterCompressor
+与 Register 相同，同一 CompressType 重复注册返回错误
+*/
+func RegisterCompressor(typ CompressType, c Compressor) error {
+	if typ == CompressNone || c == nil {
+		return errors.New("rpc codec: register with empty compress type or nil Compressor")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if _, dup := compressorMap[typ]; dup {
+		return fmt.Errorf("rpc codec: compress type %s already registered", typ)
+	}
+	compressorMap[typ] = c
+	return nil
+}
+
+// GetCompressor 未注册时返回 nil
+func GetCompressor(typ CompressType) Compressor {
+	mu.RLock()
+	defer mu.RUnlock()
+	return compressorMap[typ]
+}
+
+/*
+Compressed
+包装任意 Codec 的构造函数，得到带压缩的 Codec。
+
+内部 Codec 不直接读写连接，而是读写 compressConn：
+每次 Write 得到的一条完整消息（header + body）作为一帧发送，帧格式为
+
+| flag | uvarint len | payload |
+
+消息不小于 threshold 且压缩后更短时 flag 为 1，payload 为压缩数据；否则 flag 为 0，原样发送，
+小消息因此不会为压缩付出额外开销
+*/
+func Compressed(f NewCodecFunc, c Compressor, threshold int) NewCodecFunc {
+	return LimitCompressed(f, c, threshold, Limits{})
+}
+
+/*
+LimitCompressed
+与 Compressed 相同，同时限制读取的消息：内部 Codec 由 Limit 包装，限制解压后的 header 与 body；
+一帧即一条完整的消息，帧长度在分配之前检查，解压时最多产生同样多的字节，
+上限为 MaxHeaderSize 与 MaxBodySize 之和（见 Limits.frameLimit）。
+超出时返回 ErrFrameTooLarge 并调用 Exceeded，连接不再可用
+*/
+func LimitCompressed(f NewCodecFunc, c Compressor, threshold int, l Limits) NewCodecFunc {
+	if threshold <= 0 {
+		threshold = DefaultCompressThreshold
+	}
+	f = Limit(f, l)
+	return func(conn io.ReadWriteCloser) Codec {
+		cc := &compressConn{conn: conn, r: bufio.NewReader(conn), c: c, limits: l, max: l.frameLimit()}
+		return &CompressCodec{Codec: f(cc), cc: cc, threshold: threshold}
+	}
+}
+
+const (
+	frameRaw byte = iota
+	frameCompressed
+)
+
+/*
+CompressCodec
+Write 完成后把内部 Codec 写入的数据作为一帧发出，读取时由 compressConn 按帧解压
+*/
+type CompressCodec struct {
+	Codec
+	cc        *compressConn
+	threshold int
+}
+
+var _ Codec = (*CompressCodec)(nil)
+
+func (c *CompressCodec) Write(header *Header, body interface{}) error {
+	defer c.cc.out.Reset()
+	if err := c.Codec.Write(header, body); err != nil {
+		return err
+	}
+	if err := c.cc.flush(c.threshold); err != nil {
+		_ = c.Close()
+		return err
+	}
+	return nil
+}
+
+/*
+compressConn
+内部 Codec 看到的连接：写入暂存在 out 中，读取时按帧从真实连接读出并解压
+*/
+type compressConn struct {
+	conn   io.ReadWriteCloser
+	r      *bufio.Reader
+	c      Compressor
+	limits Limits
+	max    int          // 一帧压缩前、解压后的上限
+	out    bytes.Buffer // 尚未成帧的写入数据
+	in     []byte       // 当前帧中尚未被读取的数据
+}
+
+func (cc *compressConn) Write(p []byte) (int, error) {
+	return cc.out.Write(p)
+}
+
+func (cc *compressConn) Read(p []byte) (int, error) {
+	for len(cc.in) == 0 {
+		if err := cc.readFrame(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, cc.in)
+	cc.in = cc.in[n:]
+	return n, nil
+}
+
+func (cc *compressConn) Close() error {
+	return cc.conn.Close()
+}
+
+func (cc *compressConn) readFrame() error {
+	flag, err := cc.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	n, err := binary.ReadUvarint(cc.r)
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	if n > uint64(cc.max) {
+		return cc.limits.exceeded(fmt.Errorf("%w: %d bytes, limit %d", ErrFrameTooLarge, n, cc.max))
+	}
+	data := make([]byte, n)
+	if _, err = io.ReadFull(cc.r, data); err != nil {
+		return unexpectedEOF(err)
+	}
+	switch flag {
+	case frameRaw:
+	case frameCompressed:
+		if data, err = decompress(cc.c, data, cc.max); err != nil {
+			if errors.Is(err, ErrFrameTooLarge) {
+				return cc.limits.exceeded(fmt.Errorf("%w: decompressed, limit %d", ErrFrameTooLarge, cc.max))
+			}
+			return fmt.Errorf("rpc codec: decompress error: %w", err)
+		}
+	default:
+		return fmt.Errorf("rpc codec: invalid frame flag %d", flag)
+	}
+	cc.in = data
+	return nil
+}
+
+// flush 把 out 中的一条消息作为一帧写入真实连接
+func (cc *compressConn) flush(threshold int) error {
+	flag, data := frameRaw, cc.out.Bytes()
+	if len(data) >= threshold {
+		compressed, err := cc.c.Compress(data)
+		if err != nil {
+			return err
+		}
+		if len(compressed) < len(data) {
+			flag, data = frameCompressed, compressed
+		}
+	}
+	frame := make([]byte, 1+binary.MaxVarintLen64, 1+binary.MaxVarintLen64+len(data))
+	frame[0] = flag
+	frame = append(frame[:1+binary.PutUvarint(frame[1:], uint64(len(data)))], data...)
+	_, err := cc.conn.Write(frame)
+	return err
+}
+
+// decompress 解压后最多 max 字节
+func decompress(c Compressor, data []byte, max int) ([]byte, error) {
+	if l, ok := c.(LimitDecompressor); ok {
+		return l.DecompressLimit(data, max)
+	}
+	data, err := c.Decompress(data)
+	if err == nil && len(data) > max {
+		return nil, ErrFrameTooLarge
+	}
+	return data, err
+}
+
+// readAllLimit 从 r 读出全部数据，超出 max 字节时返回 ErrFrameTooLarge
+func readAllLimit(r io.Reader, max int) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, int64(max)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > max {
+		return nil, ErrFrameTooLarge
+	}
+	return data, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// ----------------- Compressor 实现 --------------
+
+type gzipCompressor struct {
+	writers sync.Pool
+}
+
+func (g *gzipCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, ok := g.writers.Get().(*gzip.Writer)
+	if ok {
+		w.Reset(&buf)
+	} else {
+		w = gzip.NewWriter(&buf)
+	}
+	defer g.writers.Put(w)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (g *gzipCompressor) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = r.Close() }()
+	return io.ReadAll(r)
+}
+
+func (g *gzipCompressor) DecompressLimit(data []byte, max int) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = r.Close() }()
+	return readAllLimit(r, max)
+}
+
+type snappyCompressor struct{}
+
+func (snappyCompressor) Compress(data []byte) ([]byte, error) {
+	return snappy.Encode(nil, data), nil
+}
+
+func (snappyCompressor) Decompress(data []byte) ([]byte, error) {
+	return snappy.Decode(nil, data)
+}
+
+// DecompressLimit snappy 的数据开头记录了解压后的长度，解压之前即可检查
+func (snappyCompressor) DecompressLimit(data []byte, max int) ([]byte, error) {
+	n, err := snappy.DecodedLen(data)
+	if err != nil {
+		return nil, err
+	}
+	if n > max {
+		return nil, ErrFrameTooLarge
+	}
+	return snappy.Decode(nil, data)
+}
+
+/*
+zstdCompressor
+zstd 的 Encoder/Decoder 创建开销较大，首次使用时创建，EncodeAll/DecodeAll 可以并发调用；
+DecompressLimit 需要流式解压，使用 readers 中的 Decoder
+*/
+type zstdCompressor struct {
+	once    sync.Once
+	enc     *zstd.Encoder
+	dec     *zstd.Decoder
+	err     error
+	readers sync.Pool
+}
+
+func (z *zstdCompressor) init() error {
+	z.once.Do(func() {
+		if z.enc, z.err = zstd.NewWriter(nil); z.err != nil {
+			return
+		}
+		z.dec, z.err = zstd.NewReader(nil)
+	})
+	return z.err
+}
+
+func (z *zstdCompressor) Compress(data []byte) ([]byte, error) {
+	if err := z.init(); err != nil {
+		return nil, err
+	}
+	return z.enc.EncodeAll(data, nil), nil
+}
+
+func (z *zstdCompressor) Decompress(data []byte) ([]byte, error) {
+	if err := z.init(); err != nil {
+		return nil, err
+	}
+	return z.dec.DecodeAll(data, nil)
+}
+
+func (z *zstdCompressor) DecompressLimit(data []byte, max int) ([]byte, error) {
+	d, ok := z.readers.Get().(*zstd.Decoder)
+	var err error
+	if ok {
+		err = d.Reset(bytes.NewReader(data))
+	} else {
+		// 并发数为 1 时同步解压，Decoder 不持有协程，放回 sync.Pool 后可以直接被回收
+		d, err = zstd.NewReader(bytes.NewReader(data), zstd.WithDecoderConcurrency(1))
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer z.readers.Put(d)
+	return readAllLimit(d, max)
+}
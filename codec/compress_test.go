@@ -0,0 +1,86 @@
+package codec
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestCompressed(t *testing.T) {
+	for _, typ := range []CompressType{CompressGzip, CompressSnappy, CompressZstd} {
+		t.Run(string(typ), func(t *testing.T) {
+			conn := new(bufferConn)
+			cc := Compressed(NewGobCodec, GetCompressor(typ), 256)(conn)
+
+			large := strings.Repeat("myGoRPC ", 1024)
+			_assert(cc.Write(&Header{Service: "Foo", Method: "Large", Seq: 1}, large) == nil, "failed to write large message")
+			_assert(conn.Bytes()[0] == frameCompressed, "large message should be compressed")
+			_assert(conn.Len() < len(large), "compressed frame should be smaller than body, got %d", conn.Len())
+
+			n := conn.Len()
+			_assert(cc.Write(&Header{Service: "Foo", Method: "Small", Seq: 2}, "small") == nil, "failed to write small message")
+			_assert(conn.Bytes()[n] == frameRaw, "small message should skip compression")
+
+			var header Header
+			var body string
+			_assert(cc.ReadHeader(&header) == nil && header.Method == "Large", "header mismatch: %+v", header)
+			_assert(cc.ReadBody(&body) == nil && body == large, "large body mismatch")
+			_assert(cc.ReadHeader(&header) == nil && header.Method == "Small", "header mismatch: %+v", header)
+			_assert(cc.ReadBody(&body) == nil && body == "small", "small body mismatch: %s", body)
+			_assert(cc.ReadHeader(&header) == io.EOF, "expect io.EOF at the end of stream")
+		})
+	}
+}
+
+func TestRegisterCompressor(t *testing.T) {
+	_assert(GetCompressor(CompressNone) == nil, "none should have no compressor")
+	_assert(RegisterCompressor(CompressGzip, snappyCompressor{}) != nil, "expect an error on duplicate registration")
+	_assert(RegisterCompressor(CompressNone, snappyCompressor{}) != nil, "expect an error on empty compress type")
+}
+
+/*
+测试压缩连接的大小限制。
+帧长度在分配之前检查，解压后超出 MaxHeaderSize 与 MaxBodySize 之和的帧同样被拒绝，
+没有实现 LimitDecompressor 的 Compressor 解压后检查
+*/
+func TestLimitCompressed(t *testing.T) {
+	compressors := map[string]Compressor{
+		"fallback": struct{ Compressor }{GetCompressor(CompressGzip)},
+	}
+	for _, typ := range []CompressType{CompressGzip, CompressSnappy, CompressZstd} {
+		compressors[string(typ)] = GetCompressor(typ)
+	}
+	for name, c := range compressors {
+		t.Run(name, func(t *testing.T) {
+			var exceeded int
+			limits := Limits{MaxHeaderSize: 256, MaxBodySize: 1024, Exceeded: func(err error) {
+				_assert(errors.Is(err, ErrFrameTooLarge), "expect ErrFrameTooLarge, got %v", err)
+				exceeded++
+			}}
+			large := strings.Repeat("x", 16<<10)
+
+			conn := new(bufferConn)
+			w := Compressed(NewGobCodec, c, 256)(conn)
+			_assert(w.Write(&Header{Seq: 1}, "ok") == nil, "failed to write small message")
+			n := conn.Len()
+			_assert(w.Write(&Header{Seq: 2}, large) == nil, "failed to write large message")
+			_assert(conn.Len()-n < limits.frameLimit(), "large message should be compressed below the frame limit, got %d", conn.Len()-n)
+			cc := LimitCompressed(NewGobCodec, c, 256, limits)(conn)
+			var header Header
+			var body string
+			_assert(cc.ReadHeader(&header) == nil && header.Seq == 1, "header mismatch: %+v", header)
+			_assert(cc.ReadBody(&body) == nil && body == "ok", "body mismatch: %q", body)
+			err := cc.ReadHeader(&header)
+			_assert(errors.Is(err, ErrFrameTooLarge), "expect ErrFrameTooLarge after decompression, got %v", err)
+
+			// 不压缩的大消息按帧长度拒绝
+			conn = new(bufferConn)
+			_ = Compressed(NewGobCodec, c, len(large)*2)(conn).Write(&Header{Seq: 3}, large)
+			_assert(conn.Bytes()[0] == frameRaw, "message below the threshold should not be compressed")
+			err = LimitCompressed(NewGobCodec, c, 256, limits)(conn).ReadHeader(&header)
+			_assert(errors.Is(err, ErrFrameTooLarge), "expect ErrFrameTooLarge for a long frame, got %v", err)
+			_assert(exceeded == 2, "expect 2 exceeded, got %d", exceeded)
+		})
+	}
+}
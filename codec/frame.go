@@ -0,0 +1,227 @@
+package codec
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+)
+
+/*
+Serializer
+把单个值序列化为自包含的字节（不依赖前后的消息），供 FrameCodec 逐帧编解码
+*/
+type Serializer interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var serializerMap = make(map[Type]Serializer)
+
+/*
+RegisterSerializer
+与 Register 相同，同一 Type 重复注册返回错误；注册后该 Type 可以使用分帧传输
+*/
+func RegisterSerializer(typ Type, s Serializer) error {
+	if typ == "" || s == nil {
+		return errors.New("rpc codec: register with empty type or nil Serializer")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if _, dup := serializerMap[typ]; dup {
+		return fmt.Errorf("rpc codec: serializer %s already registered", typ)
+	}
+	serializerMap[typ] = s
+	return nil
+}
+
+// GetSerializer 未注册时返回 nil
+func GetSerializer(typ Type) Serializer {
+	mu.RLock()
+	defer mu.RUnlock()
+	return serializerMap[typ]
+}
+
+/*
+MessageError
+单条消息序列化、反序列化失败，但数据流没有错位（消息已被完整读出，或尚未写入连接），
+调用方可以只针对这条消息报错，连接继续使用
+*/
+type MessageError struct {
+	Err error
+}
+
+func (e *MessageError) Error() string {
+	return "rpc codec: " + e.Err.Error()
+}
+
+func (e *MessageError) Unwrap() error {
+	return e.Err
+}
+
+// IsMessageError err 是否只影响单条消息
+func IsMessageError(err error) bool {
+	var e *MessageError
+	return errors.As(err, &e)
+}
+
+/*
+Framed
+得到 typ 对应的分帧 Codec 构造函数，typ 没有注册 Serializer 时返回 nil
+*/
+func Framed(typ Type) NewCodecFunc {
+	s := GetSerializer(typ)
+	if s == nil {
+		return nil
+	}
+	return func(conn io.ReadWriteCloser) Codec {
+		return NewFrameCodec(conn, s)
+	}
+}
+
+/*
+FrameCodec
+
+位于具体编码之下的分帧层，header 与 body 各自序列化后加上 uvarint 长度前缀：
+
+| len | Header | len | Body | len | Header | len | Body | ...
+
+读取时先完整读出一帧再反序列化，body 非法时返回 MessageError，下一条消息不受影响；
+写入时先完成序列化，失败时不向连接写入任何数据，也不关闭连接
+*/
+type FrameCodec struct {
+	conn   io.ReadWriteCloser
+	buf    *bufio.Writer
+	r      *bufio.Reader
+	s      Serializer
+	limits Limits // 见 Limit
+}
+
+var _ Codec = (*FrameCodec)(nil)
+
+func NewFrameCodec(conn io.ReadWriteCloser, s Serializer) Codec {
+	return &FrameCodec{
+		conn: conn,
+		buf:  bufio.NewWriter(conn),
+		r:    bufio.NewReader(conn),
+		s:    s,
+	}
+}
+
+func (f *FrameCodec) Close() error {
+	return f.conn.Close()
+}
+
+// ReadHeader header 无法解析时不知道所属的 Seq，返回普通错误，由调用方关闭连接
+func (f *FrameCodec) ReadHeader(header *Header) error {
+	data, err := readFrame(f.r, f.limits.MaxHeaderSize)
+	if errors.As(err, new(*frameTooLarge)) {
+		return f.limits.exceeded(fmt.Errorf("%w: %v", ErrHeaderTooLarge, err))
+	}
+	if err != nil {
+		return err
+	}
+	*header = Header{}
+	if err = f.s.Unmarshal(data, header); err != nil {
+		return err
+	}
+	return checkMetadata(header)
+}
+
+// ReadBody body 超出限制时丢弃这一帧，返回 MessageError
+func (f *FrameCodec) ReadBody(body interface{}) error {
+	data, err := readFrame(f.r, f.limits.MaxBodySize)
+	var tl *frameTooLarge
+	if errors.As(err, &tl) {
+		if _, err = io.CopyN(io.Discard, f.r, int64(tl.size)); err != nil {
+			return unexpectedEOF(err)
+		}
+		return &MessageError{Err: f.limits.exceeded(fmt.Errorf("%w: %v", ErrBodyTooLarge, tl))}
+	}
+	if err != nil || body == nil {
+		return err
+	}
+	if err = f.s.Unmarshal(data, body); err != nil {
+		return &MessageError{Err: err}
+	}
+	return nil
+}
+
+func (f *FrameCodec) Write(header *Header, body interface{}) (err error) {
+	h, err := f.s.Marshal(header)
+	if err != nil {
+		log.Println("rpc codec.frame error encoding header:", err)
+		return &MessageError{Err: err}
+	}
+	b, err := f.s.Marshal(body)
+	if err != nil {
+		log.Println("rpc codec.frame error encoding body:", err)
+		return &MessageError{Err: err}
+	}
+	defer func() {
+		_ = f.buf.Flush()
+		if err != nil {
+			_ = f.Close()
+		}
+	}()
+	if err = writeFrame(f.buf, h); err != nil {
+		return err
+	}
+	return writeFrame(f.buf, b)
+}
+
+// frameTooLarge 帧长度超出 readFrame 的 max，帧的内容尚未读取
+type frameTooLarge struct {
+	size, max uint64
+}
+
+func (e *frameTooLarge) Error() string {
+	return fmt.Sprintf("frame of %d bytes, limit %d", e.size, e.max)
+}
+
+// frameChunk 更大的帧随着数据到达逐步分配，避免按对方声称的长度一次性分配
+const frameChunk = 64 << 10
+
+/*
+readFrame
+读取一个 uvarint 长度前缀的帧，max 大于 0 且帧更长时返回 *frameTooLarge
+*/
+func readFrame(r *bufio.Reader, max int) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if max > 0 && n > uint64(max) {
+		return nil, &frameTooLarge{size: n, max: uint64(max)}
+	}
+	if n > math.MaxInt64 {
+		return nil, fmt.Errorf("rpc codec: invalid frame length %d", n)
+	}
+	if n <= frameChunk {
+		data := make([]byte, n)
+		if _, err = io.ReadFull(r, data); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		return data, nil
+	}
+	data, err := io.ReadAll(io.LimitReader(r, int64(n)))
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(data)) < n {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return data, nil
+}
+
+func writeFrame(w *bufio.Writer, data []byte) error {
+	var l [binary.MaxVarintLen64]byte
+	if _, err := w.Write(l[:binary.PutUvarint(l[:], uint64(len(data)))]); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
@@ -0,0 +1,33 @@
+package codec
+
+import (
+	"io"
+	"testing"
+)
+
+func TestFrameCodec(t *testing.T) {
+	for _, typ := range []Type{GobType, JsonType, MsgpackType} {
+		t.Run(string(typ), func(t *testing.T) {
+			conn := new(bufferConn)
+			cc := Framed(typ)(conn)
+
+			_assert(cc.Write(&Header{Service: "Foo", Method: "Sum", Seq: 1}, "not an int") == nil, "failed to write first message")
+			_assert(cc.Write(&Header{Service: "Foo", Method: "Sum", Seq: 2}, 42) == nil, "failed to write second message")
+
+			// 无法编码的 body 不会写入任何数据
+			n := conn.Len()
+			err := cc.Write(&Header{Seq: 3}, make(chan int))
+			_assert(IsMessageError(err) && conn.Len() == n, "expect a MessageError without writing, got %v", err)
+
+			var header Header
+			var body int
+			_assert(cc.ReadHeader(&header) == nil && header.Seq == 1, "header mismatch: %+v", header)
+			err = cc.ReadBody(&body)
+			_assert(IsMessageError(err), "expect a MessageError for malformed body, got %v", err)
+
+			_assert(cc.ReadHeader(&header) == nil && header.Seq == 2, "header mismatch: %+v", header)
+			_assert(cc.ReadBody(&body) == nil && body == 42, "body mismatch: %d", body)
+			_assert(cc.ReadHeader(&header) == io.EOF, "expect io.EOF at the end of stream")
+		})
+	}
+}
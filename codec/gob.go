@@ -2,6 +2,7 @@ package codec
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/gob"
 	"io"
 	"log"
@@ -36,7 +37,12 @@ func (g *GobCodec) Close() error {
 }
 
 func (g *GobCodec) ReadHeader(header *Header) error {
-	return g.dec.Decode(header)
+	// gob 不会清空解码目标中未出现的字段，复用 header 时需要先重置
+	*header = Header{}
+	if err := g.dec.Decode(header); err != nil {
+		return err
+	}
+	return checkMetadata(header)
 }
 
 func (g *GobCodec) ReadBody(body interface{}) error {
@@ -62,3 +68,22 @@ func (g *GobCodec) Write(header *Header, body interface{}) (err error) {
 	}
 	return nil
 }
+
+/*
+gobSerializer
+每个值使用新的 Encoder 编码，自带类型信息，可以脱离前后的消息单独解码，
+代价是每条消息都要重复发送类型定义
+*/
+type gobSerializer struct{}
+
+func (gobSerializer) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobSerializer) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
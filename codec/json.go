@@ -0,0 +1,85 @@
+package codec
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+)
+
+/*
+JsonCodec
+
+与 GobCodec 结构一致，header 与 body 依次编码为两个 JSON 值，
+便于非 Go 语言的工具、甚至人工通过 telnet 与服务端交互
+*/
+type JsonCodec struct {
+	conn io.ReadWriteCloser
+	buf  *bufio.Writer
+	dec  *json.Decoder
+	enc  *json.Encoder
+}
+
+var _ Codec = (*JsonCodec)(nil)
+
+func NewJsonCodec(conn io.ReadWriteCloser) Codec {
+	buf := bufio.NewWriter(conn)
+	return &JsonCodec{
+		conn: conn,
+		buf:  buf,
+		dec:  json.NewDecoder(conn),
+		enc:  json.NewEncoder(buf),
+	}
+}
+
+func (j *JsonCodec) Close() error {
+	return j.conn.Close()
+}
+
+func (j *JsonCodec) ReadHeader(header *Header) error {
+	*header = Header{}
+	if err := j.dec.Decode(header); err != nil {
+		return err
+	}
+	return checkMetadata(header)
+}
+
+/*
+ReadBody
+json.Decoder 不能解码到 nil，body 为 nil 时读出原始 JSON 值并丢弃，保持与 gob 相同的语义
+*/
+func (j *JsonCodec) ReadBody(body interface{}) error {
+	if body == nil {
+		var discard json.RawMessage
+		return j.dec.Decode(&discard)
+	}
+	return j.dec.Decode(body)
+}
+
+func (j *JsonCodec) Write(header *Header, body interface{}) (err error) {
+	defer func() {
+		_ = j.buf.Flush()
+		if err != nil {
+			_ = j.Close()
+		}
+	}()
+	if err := j.enc.Encode(header); err != nil {
+		log.Println("rpc codec.json error encoding header:", err)
+		return err
+	}
+	if err := j.enc.Encode(body); err != nil {
+		log.Println("rpc codec.json error encoding body:", err)
+		return err
+	}
+	return nil
+}
+
+type jsonSerializer struct{}
+
+func (jsonSerializer) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonSerializer) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,30 @@
+package codec
+
+import (
+	"io"
+	"reflect"
+	"testing"
+)
+
+type jsonBody struct {
+	Name  string
+	Items []int
+}
+
+func TestJsonCodec(t *testing.T) {
+	conn := new(bufferConn)
+	cc := NewJsonCodec(conn)
+
+	h := &Header{Service: "Foo", Method: "Sum", Seq: 7, Error: "oops"}
+	_assert(cc.Write(h, &jsonBody{Name: "a", Items: []int{1, 2}}) == nil, "failed to write first message")
+	_assert(cc.Write(&Header{Seq: 8}, "discarded") == nil, "failed to write second message")
+
+	var header Header
+	var body jsonBody
+	_assert(cc.ReadHeader(&header) == nil && reflect.DeepEqual(header, *h), "header mismatch: %+v", header)
+	_assert(cc.ReadBody(&body) == nil && body.Name == "a" && len(body.Items) == 2, "body mismatch: %+v", body)
+
+	_assert(cc.ReadHeader(&header) == nil && header.Seq == 8, "second header mismatch: %+v", header)
+	_assert(cc.ReadBody(nil) == nil, "nil body should be discarded")
+	_assert(cc.ReadHeader(&header) == io.EOF, "expect io.EOF at the end of stream")
+}
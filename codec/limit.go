@@ -0,0 +1,124 @@
+package codec
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+var (
+	ErrHeaderTooLarge = errors.New("header too large")
+	ErrBodyTooLarge   = errors.New("body too large")
+	ErrFrameTooLarge  = errors.New("compressed frame too large") // 见 LimitCompressed
+)
+
+/*
+Limits
+读取单条消息的大小上限（字节），0 即为无限制；
+Exceeded 不为 nil 时每次超出限制都会被调用，用于统计
+*/
+type Limits struct {
+	MaxHeaderSize int
+	MaxBodySize   int
+	Exceeded      func(err error)
+}
+
+// frameSlack 内部 Codec 在 header 与 body 之外写入的数据，例如 FrameCodec 的长度前缀
+const frameSlack = 64
+
+/*
+frameLimit
+压缩连接上一帧（一条完整消息）的上限：header 与 body 的上限之和，
+任一没有限制时为 MaxFrameSize
+*/
+func (l Limits) frameLimit() int {
+	if l.MaxHeaderSize <= 0 || l.MaxBodySize <= 0 {
+		return MaxFrameSize
+	}
+	return min(l.MaxHeaderSize+l.MaxBodySize+frameSlack, MaxFrameSize)
+}
+
+func (l Limits) exceeded(err error) error {
+	if l.Exceeded != nil {
+		l.Exceeded(err)
+	}
+	return err
+}
+
+/*
+Limit
+包装 Codec 构造函数，限制读取的消息大小，避免按对方声称的长度分配内存：
+ 1. FrameCodec 在分配之前按帧长度检查：header 超出时返回 ErrHeaderTooLarge，连接不再可用；
+    body 超出时丢弃这一帧，返回包装了 ErrBodyTooLarge 的 MessageError，连接继续使用
+ 2. 其他 Codec 按从连接读取的字节数检查，读取超出限制的部分时返回 ErrHeaderTooLarge、ErrBodyTooLarge，
+    此时数据流已经错位，连接不再可用。预读的数据计入读取它的消息，但不会使未超出限制的消息失败
+*/
+func Limit(f NewCodecFunc, l Limits) NewCodecFunc {
+	if l.MaxHeaderSize <= 0 && l.MaxBodySize <= 0 {
+		return f
+	}
+	return func(conn io.ReadWriteCloser) Codec {
+		r := &limitReader{ReadWriteCloser: conn}
+		c := f(r)
+		if fc, ok := c.(*FrameCodec); ok {
+			fc.limits = l
+			return fc
+		}
+		return &limitCodec{Codec: c, r: r, limits: l}
+	}
+}
+
+type limitCodec struct {
+	Codec
+	r      *limitReader
+	limits Limits
+}
+
+func (c *limitCodec) ReadHeader(header *Header) error {
+	c.r.reset(c.limits.MaxHeaderSize, ErrHeaderTooLarge)
+	err := c.Codec.ReadHeader(header)
+	if errors.Is(err, ErrHeaderTooLarge) {
+		return c.limits.exceeded(fmt.Errorf("%w: limit %d", ErrHeaderTooLarge, c.limits.MaxHeaderSize))
+	}
+	return err
+}
+
+func (c *limitCodec) ReadBody(body interface{}) error {
+	c.r.reset(c.limits.MaxBodySize, ErrBodyTooLarge)
+	err := c.Codec.ReadBody(body)
+	if errors.Is(err, ErrBodyTooLarge) {
+		return c.limits.exceeded(fmt.Errorf("%w: limit %d", ErrBodyTooLarge, c.limits.MaxBodySize))
+	}
+	return err
+}
+
+/*
+limitReader
+每次 reset 后最多读取 n 字节，之后返回 err；单次 Read 被截断到剩余的额度，
+因此只有消息本身超出限制时才会返回 err
+*/
+type limitReader struct {
+	io.ReadWriteCloser
+	limited   bool
+	remaining int
+	err       error
+}
+
+func (r *limitReader) reset(n int, err error) {
+	r.limited, r.remaining, r.err = n > 0, n, err
+}
+
+func (r *limitReader) Read(p []byte) (int, error) {
+	if !r.limited {
+		return r.ReadWriteCloser.Read(p)
+	}
+	if r.remaining <= 0 {
+		return 0, r.err
+	}
+	if len(p) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err := r.ReadWriteCloser.Read(p)
+	r.remaining -= n
+	return n, err
+}
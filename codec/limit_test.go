@@ -0,0 +1,44 @@
+package codec
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+/*
+测试消息大小限制。
+分帧时超出限制的 body 被丢弃，下一条消息仍然可以读取；不分帧时超出限制即返回错误；
+每次超出限制都会调用 Exceeded
+*/
+func TestLimit(t *testing.T) {
+	var exceeded int
+	limits := Limits{MaxHeaderSize: 1 << 10, MaxBodySize: 64, Exceeded: func(error) { exceeded++ }}
+	large := strings.Repeat("x", 128)
+
+	conn := new(bufferConn)
+	w := Framed(GobType)(conn)
+	_assert(w.Write(&Header{Seq: 1}, large) == nil, "failed to write first message")
+	_assert(w.Write(&Header{Seq: 2}, "ok") == nil, "failed to write second message")
+	_assert(w.Write(&Header{Seq: 3, Service: strings.Repeat(large, 9)}, "ok") == nil, "failed to write third message")
+
+	cc := Limit(Framed(GobType), limits)(conn)
+	var header Header
+	var body string
+	_assert(cc.ReadHeader(&header) == nil && header.Seq == 1, "header mismatch: %+v", header)
+	err := cc.ReadBody(&body)
+	_assert(IsMessageError(err) && errors.Is(err, ErrBodyTooLarge), "expect ErrBodyTooLarge, got %v", err)
+	_assert(cc.ReadHeader(&header) == nil && header.Seq == 2, "header mismatch: %+v", header)
+	_assert(cc.ReadBody(&body) == nil && body == "ok", "body mismatch: %q", body)
+	err = cc.ReadHeader(&header)
+	_assert(errors.Is(err, ErrHeaderTooLarge), "expect ErrHeaderTooLarge, got %v", err)
+
+	// 不分帧时预读的数据计入 header，body 需要超出预读的部分
+	conn = new(bufferConn)
+	_ = NewGobCodec(conn).Write(&Header{Seq: 1}, strings.Repeat(large, 32))
+	cc = Limit(NewGobCodec, limits)(conn)
+	_assert(cc.ReadHeader(&header) == nil && header.Seq == 1, "header mismatch: %+v", header)
+	err = cc.ReadBody(&body)
+	_assert(errors.Is(err, ErrBodyTooLarge), "expect ErrBodyTooLarge, got %v", err)
+	_assert(exceeded == 3, "expect 3 exceeded, got %d", exceeded)
+}
@@ -0,0 +1,82 @@
+package codec
+
+import (
+	"bufio"
+	"io"
+	"log"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+/*
+MsgpackCodec
+
+与 GobCodec 结构一致，header 与 body 依次编码为两个 MessagePack 值，
+结构体按字段名编码为 map，Python、JavaScript 等语言的 msgpack 库可以直接解析
+*/
+type MsgpackCodec struct {
+	conn io.ReadWriteCloser
+	buf  *bufio.Writer
+	dec  *msgpack.Decoder
+	enc  *msgpack.Encoder
+}
+
+var _ Codec = (*MsgpackCodec)(nil)
+
+func NewMsgpackCodec(conn io.ReadWriteCloser) Codec {
+	buf := bufio.NewWriter(conn)
+	return &MsgpackCodec{
+		conn: conn,
+		buf:  buf,
+		dec:  msgpack.NewDecoder(conn),
+		enc:  msgpack.NewEncoder(buf),
+	}
+}
+
+func (m *MsgpackCodec) Close() error {
+	return m.conn.Close()
+}
+
+func (m *MsgpackCodec) ReadHeader(header *Header) error {
+	*header = Header{}
+	if err := m.dec.Decode(header); err != nil {
+		return err
+	}
+	return checkMetadata(header)
+}
+
+// ReadBody body 为 nil 时跳过下一个值
+func (m *MsgpackCodec) ReadBody(body interface{}) error {
+	if body == nil {
+		return m.dec.Skip()
+	}
+	return m.dec.Decode(body)
+}
+
+func (m *MsgpackCodec) Write(header *Header, body interface{}) (err error) {
+	defer func() {
+		_ = m.buf.Flush()
+		if err != nil {
+			_ = m.Close()
+		}
+	}()
+	if err := m.enc.Encode(header); err != nil {
+		log.Println("rpc codec.msgpack error encoding header:", err)
+		return err
+	}
+	if err := m.enc.Encode(body); err != nil {
+		log.Println("rpc codec.msgpack error encoding body:", err)
+		return err
+	}
+	return nil
+}
+
+type msgpackSerializer struct{}
+
+func (msgpackSerializer) Marshal(v interface{}) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+func (msgpackSerializer) Unmarshal(data []byte, v interface{}) error {
+	return msgpack.Unmarshal(data, v)
+}
@@ -0,0 +1,297 @@
+package codec
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+ProtobufCodec
+
+header 与 body 各自编码为一个 protobuf 消息，消息前加上 uvarint 长度，即：
+
+| len | Header | len | Body | len | Header | len | Body | ...
+
+header 按照下面的 proto 定义手工编码，避免引入生成代码：
+
+	message Header {
+	  string service = 1;
+	  string method  = 2;
+	  uint64 seq     = 3;
+	  string error   = 4;
+	  map<string, string> metadata = 5;
+	  uint32 kind    = 6;
+	  int64 timeout  = 7;
+	  uint32 code    = 8;
+	  repeated string details = 9;
+	  uint32 window  = 10;
+	}
+
+body 必须实现 proto.Message；服务端回复错误时的 invalidRequest（struct{}{}）以及 nil 编码为空消息
+*/
+type ProtobufCodec struct {
+	conn io.ReadWriteCloser
+	buf  *bufio.Writer
+	r    *bufio.Reader
+}
+
+var _ Codec = (*ProtobufCodec)(nil)
+
+// ErrNotProtoMessage body 没有实现 proto.Message
+var ErrNotProtoMessage = errors.New("rpc codec.protobuf: body is not a proto.Message")
+
+const (
+	protoHeaderService protowire.Number = iota + 1
+	protoHeaderMethod
+	protoHeaderSeq
+	protoHeaderError
+	protoHeaderMetadata
+	protoHeaderKind
+	protoHeaderTimeout
+	protoHeaderCode
+	protoHeaderDetails
+	protoHeaderWindow
+)
+
+// map 的每个键值对编码为一个嵌套消息 { string key = 1; string value = 2; }
+const (
+	protoMapKey protowire.Number = iota + 1
+	protoMapValue
+)
+
+func NewProtobufCodec(conn io.ReadWriteCloser) Codec {
+	return &ProtobufCodec{
+		conn: conn,
+		buf:  bufio.NewWriter(conn),
+		r:    bufio.NewReader(conn),
+	}
+}
+
+func (p *ProtobufCodec) Close() error {
+	return p.conn.Close()
+}
+
+func (p *ProtobufCodec) ReadHeader(header *Header) error {
+	data, err := readFrame(p.r, 0)
+	if err != nil {
+		return err
+	}
+	if err = unmarshalProtoHeader(data, header); err != nil {
+		return err
+	}
+	return checkMetadata(header)
+}
+
+/*
+ReadBody
+无论 body 是否合法，都先读出完整的消息，保证后续数据流不会错位，因此错误均为 MessageError
+*/
+func (p *ProtobufCodec) ReadBody(body interface{}) error {
+	data, err := readFrame(p.r, 0)
+	if err != nil || body == nil {
+		return err
+	}
+	if err = protobufSerializer.Unmarshal(data, body); err != nil {
+		return &MessageError{Err: err}
+	}
+	return nil
+}
+
+/*
+Write
+body 在写入任何数据之前编码，编码失败（例如不是 proto.Message）时返回 MessageError，连接继续可用；
+写入失败时关闭连接
+*/
+func (p *ProtobufCodec) Write(header *Header, body interface{}) (err error) {
+	data, err := protobufSerializer.Marshal(body)
+	if err != nil {
+		return &MessageError{Err: err}
+	}
+	defer func() {
+		_ = p.buf.Flush()
+		if err != nil {
+			_ = p.Close()
+		}
+	}()
+	if err := writeFrame(p.buf, marshalProtoHeader(header)); err != nil {
+		log.Println("rpc codec.protobuf error encoding header:", err)
+		return err
+	}
+	if err := writeFrame(p.buf, data); err != nil {
+		log.Println("rpc codec.protobuf error encoding body:", err)
+		return err
+	}
+	return nil
+}
+
+/*
+protoSerializer
+Header 按上面的 proto 定义手工编码，body 必须实现 proto.Message，struct{}{} 与 nil 编码为空消息
+*/
+type protoSerializer struct{}
+
+var protobufSerializer protoSerializer
+
+func (protoSerializer) Marshal(v interface{}) ([]byte, error) {
+	switch b := v.(type) {
+	case nil, struct{}:
+		return nil, nil
+	case *Header:
+		return marshalProtoHeader(b), nil
+	case proto.Message:
+		return proto.Marshal(b)
+	default:
+		return nil, fmt.Errorf("%w: %T", ErrNotProtoMessage, v)
+	}
+}
+
+func (protoSerializer) Unmarshal(data []byte, v interface{}) error {
+	switch b := v.(type) {
+	case *Header:
+		return unmarshalProtoHeader(data, b)
+	case proto.Message:
+		return proto.Unmarshal(data, b)
+	default:
+		return fmt.Errorf("%w: %T", ErrNotProtoMessage, v)
+	}
+}
+
+func marshalProtoHeader(h *Header) []byte {
+	var b []byte
+	if h.Service != "" {
+		b = protowire.AppendTag(b, protoHeaderService, protowire.BytesType)
+		b = protowire.AppendString(b, h.Service)
+	}
+	if h.Method != "" {
+		b = protowire.AppendTag(b, protoHeaderMethod, protowire.BytesType)
+		b = protowire.AppendString(b, h.Method)
+	}
+	if h.Seq != 0 {
+		b = protowire.AppendTag(b, protoHeaderSeq, protowire.VarintType)
+		b = protowire.AppendVarint(b, h.Seq)
+	}
+	if h.Error != "" {
+		b = protowire.AppendTag(b, protoHeaderError, protowire.BytesType)
+		b = protowire.AppendString(b, h.Error)
+	}
+	if h.Kind != KindRequest {
+		b = protowire.AppendTag(b, protoHeaderKind, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(h.Kind))
+	}
+	if h.Timeout != 0 {
+		b = protowire.AppendTag(b, protoHeaderTimeout, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(h.Timeout))
+	}
+	if h.Code != 0 {
+		b = protowire.AppendTag(b, protoHeaderCode, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(h.Code))
+	}
+	for _, d := range h.Details {
+		b = protowire.AppendTag(b, protoHeaderDetails, protowire.BytesType)
+		b = protowire.AppendString(b, d)
+	}
+	if h.Window != 0 {
+		b = protowire.AppendTag(b, protoHeaderWindow, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(h.Window))
+	}
+	for k, v := range h.Metadata {
+		var entry []byte
+		entry = protowire.AppendTag(entry, protoMapKey, protowire.BytesType)
+		entry = protowire.AppendString(entry, k)
+		entry = protowire.AppendTag(entry, protoMapValue, protowire.BytesType)
+		entry = protowire.AppendString(entry, v)
+		b = protowire.AppendTag(b, protoHeaderMetadata, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	return b
+}
+
+// unmarshalProtoHeader 未知字段直接跳过，便于 header 以后增加字段
+func unmarshalProtoHeader(b []byte, h *Header) error {
+	*h = Header{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch {
+		case num == protoHeaderService && typ == protowire.BytesType:
+			h.Service, n = protowire.ConsumeString(b)
+		case num == protoHeaderMethod && typ == protowire.BytesType:
+			h.Method, n = protowire.ConsumeString(b)
+		case num == protoHeaderSeq && typ == protowire.VarintType:
+			h.Seq, n = protowire.ConsumeVarint(b)
+		case num == protoHeaderError && typ == protowire.BytesType:
+			h.Error, n = protowire.ConsumeString(b)
+		case num == protoHeaderKind && typ == protowire.VarintType:
+			var kind uint64
+			kind, n = protowire.ConsumeVarint(b)
+			h.Kind = Kind(kind)
+		case num == protoHeaderTimeout && typ == protowire.VarintType:
+			var timeout uint64
+			timeout, n = protowire.ConsumeVarint(b)
+			h.Timeout = int64(timeout)
+		case num == protoHeaderCode && typ == protowire.VarintType:
+			var code uint64
+			code, n = protowire.ConsumeVarint(b)
+			h.Code = uint32(code)
+		case num == protoHeaderDetails && typ == protowire.BytesType:
+			var d string
+			d, n = protowire.ConsumeString(b)
+			h.Details = append(h.Details, d)
+		case num == protoHeaderWindow && typ == protowire.VarintType:
+			var window uint64
+			window, n = protowire.ConsumeVarint(b)
+			h.Window = uint32(window)
+		case num == protoHeaderMetadata && typ == protowire.BytesType:
+			var entry []byte
+			if entry, n = protowire.ConsumeBytes(b); n >= 0 {
+				if err := unmarshalProtoMapEntry(entry, h); err != nil {
+					return err
+				}
+			}
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+func unmarshalProtoMapEntry(b []byte, h *Header) error {
+	var k, v string
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch {
+		case num == protoMapKey && typ == protowire.BytesType:
+			k, n = protowire.ConsumeString(b)
+		case num == protoMapValue && typ == protowire.BytesType:
+			v, n = protowire.ConsumeString(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	if h.Metadata == nil {
+		h.Metadata = make(map[string]string)
+	}
+	h.Metadata[k] = v
+	return nil
+}
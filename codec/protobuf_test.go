@@ -0,0 +1,49 @@
+package codec
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestProtobufCodec(t *testing.T) {
+	conn := new(bufferConn)
+	cc := NewProtobufCodec(conn)
+
+	h := &Header{Service: "Foo", Method: "Echo", Seq: 9, Error: "oops", Kind: KindCancel, Timeout: 1500000000,
+		Code: 5, Details: []string{"a", "b"}, Window: 64}
+	_assert(cc.Write(h, wrapperspb.String("hello")) == nil, "failed to write proto message")
+	_assert(cc.Write(&Header{Seq: 10}, struct{}{}) == nil, "failed to write empty body")
+	_assert(cc.Write(&Header{Seq: 11}, wrapperspb.Int64(42)) == nil, "failed to write proto message")
+
+	var header Header
+	body := new(wrapperspb.StringValue)
+	_assert(cc.ReadHeader(&header) == nil && reflect.DeepEqual(header, *h), "header mismatch: %+v", header)
+	_assert(cc.ReadBody(body) == nil && body.GetValue() == "hello", "body mismatch: %v", body)
+
+	_assert(cc.ReadHeader(&header) == nil && header.Seq == 10, "second header mismatch: %+v", header)
+	var notProto int
+	err := cc.ReadBody(&notProto)
+	_assert(errors.Is(err, ErrNotProtoMessage), "expect ErrNotProtoMessage, got %v", err)
+
+	// 非法 body 被完整读出，后续消息不受影响
+	n := new(wrapperspb.Int64Value)
+	_assert(cc.ReadHeader(&header) == nil && header.Seq == 11, "third header mismatch: %+v", header)
+	_assert(cc.ReadBody(n) == nil && n.GetValue() == 42, "body mismatch: %v", n)
+	_assert(cc.ReadHeader(&header) == io.EOF, "expect io.EOF at the end of stream")
+}
+
+// 测试 body 不是 proto.Message 时只有这一条消息失败，连接仍然可用
+func TestProtobufCodec_WriteNotProto(t *testing.T) {
+	conn := new(bufferConn)
+	cc := NewProtobufCodec(conn)
+	err := cc.Write(&Header{Seq: 1}, 1)
+	_assert(IsMessageError(err) && errors.Is(err, ErrNotProtoMessage), "expect a MessageError wrapping ErrNotProtoMessage, got %v", err)
+	_assert(conn.Len() == 0, "nothing should be written")
+	_assert(cc.Write(&Header{Seq: 2}, nil) == nil, "the codec should still be usable")
+	var header Header
+	_assert(cc.ReadHeader(&header) == nil && header.Seq == 2, "header mismatch: %+v", header)
+}
@@ -0,0 +1,47 @@
+package codes
+
+import "strconv"
+
+/*
+Code
+调用结果的错误码，随 codec.Header.Code 在服务端与客户端之间传递；
+取值与 gRPC 保持一致，已有的值不会改变
+*/
+type Code uint32
+
+const (
+	OK                Code = 0  // 成功
+	Canceled          Code = 1  // 调用方取消
+	Unknown           Code = 2  // 未知错误，例如方法返回的普通 error
+	InvalidArgument   Code = 3  // 请求不合法，例如参数无法解码
+	DeadlineExceeded  Code = 4  // 超时
+	NotFound          Code = 5  // 服务或方法不存在
+	PermissionDenied  Code = 7  // 没有权限
+	ResourceExhausted Code = 8  // 超出限制，例如 Metadata 过大
+	Unimplemented     Code = 12 // 不支持的操作
+	Internal          Code = 13 // 服务端内部错误，例如方法 panic、回复无法编码
+	Unavailable       Code = 14 // 服务暂时不可用，例如正在关闭
+	Unauthenticated   Code = 16 // 未认证
+)
+
+var names = map[Code]string{
+	OK:                "OK",
+	Canceled:          "Canceled",
+	Unknown:           "Unknown",
+	InvalidArgument:   "InvalidArgument",
+	DeadlineExceeded:  "DeadlineExceeded",
+	NotFound:          "NotFound",
+	PermissionDenied:  "PermissionDenied",
+	ResourceExhausted: "ResourceExhausted",
+	Unimplemented:     "Unimplemented",
+	Internal:          "Internal",
+	Unavailable:       "Unavailable",
+	Unauthenticated:   "Unauthenticated",
+}
+
+func (c Code) String() string {
+	if name, ok := names[c]; ok {
+		return name
+	}
+	return "Code(" + strconv.FormatUint(uint64(c), 10) + ")"
+}
@@ -0,0 +1,148 @@
+package myGoRPC
+
+import (
+	"context"
+	"myGoRPC/codes"
+	"myGoRPC/status"
+	"time"
+)
+
+// errServerBusy 达到 Server.MaxConcurrency 且队列已满时，新请求收到的错误
+var errServerBusy = status.Error(codes.ResourceExhausted, "rpc server: too many concurrent requests")
+
+/*
+limiter
+整个服务端同时执行的方法数，额度用尽时最多 Server.QueueSize 个请求排队等待
+*/
+type limiter struct {
+	slots   chan struct{}
+	waiting chan struct{} // 正在排队的请求，容量为 Server.QueueSize
+}
+
+// concurrency 设置了 MaxConcurrency 时返回服务端的 limiter，否则返回 nil
+func (server *Server) concurrency() *limiter {
+	server.limiterOnce.Do(func() {
+		if server.MaxConcurrency > 0 {
+			server.limiter = &limiter{
+				slots:   make(chan struct{}, server.MaxConcurrency),
+				waiting: make(chan struct{}, server.QueueSize),
+			}
+		}
+	})
+	return server.limiter
+}
+
+/*
+admit
+连接上正在执行与等待额度的请求达到 MaxConnConcurrency + ConnQueueSize 时，读循环在这里暂停，
+不再读取该连接（TCP 背压），直到有请求处理完成（见 leave），连接被关闭时返回 ErrServerClosed。
+连接上有客户端流时不暂停而是返回 errServerBusy：流的消息需要读循环读取，暂停会使流无法结束
+*/
+func (server *Server) admit(c *serverConn, streaming bool) error {
+	if c.admitted == nil {
+		return nil
+	}
+	select {
+	case c.admitted <- struct{}{}:
+		return nil
+	default:
+	}
+	if streaming {
+		server.metrics.concurrencyRejected.Add(1)
+		return errServerBusy
+	}
+	server.metrics.connPaused.Add(1)
+	select {
+	case c.admitted <- struct{}{}:
+		return nil
+	case <-c.quit:
+		return ErrServerClosed
+	}
+}
+
+// leave 请求处理完成，暂停的读循环可以继续，见 admit
+func (c *serverConn) leave() {
+	if c.admitted != nil {
+		<-c.admitted
+	}
+}
+
+/*
+acquire
+在处理请求的协程中为方法取得并发额度（普通调用、单向调用与流），返回方法返回后释放额度的函数：
+ 1. 连接达到 MaxConnConcurrency 时等待连接上的方法返回，等待的请求数由 admit 限制
+ 2. 服务端达到 MaxConcurrency 时排队，队列已满时返回 errServerBusy
+
+ctx 即方法的 context（见 handleContext），等待期间截止时间到达时返回 codes.DeadlineExceeded；
+请求被取消（codec.KindCancel）或连接断开时返回 codes.Canceled。
+等待不占用读循环（读循环只在 admit 中暂停），取消消息与连接的关闭都能及时被读到
+*/
+func (server *Server) acquire(ctx context.Context, c *serverConn) (func(), error) {
+	if c.slots != nil {
+		select {
+		case c.slots <- struct{}{}:
+		default:
+			server.metrics.connQueued.Add(1)
+			start := time.Now()
+			select {
+			case c.slots <- struct{}{}:
+				server.metrics.connQueueWait.Add(int64(time.Since(start)))
+			case <-ctx.Done():
+				return nil, waitError(ctx)
+			}
+		}
+	}
+	l := server.concurrency()
+	if l == nil {
+		return c.release, nil
+	}
+	if err := server.wait(ctx, l); err != nil {
+		c.release()
+		return nil, err
+	}
+	return func() {
+		<-l.slots
+		c.release()
+	}, nil
+}
+
+// wait 取得服务端的额度，必要时排队；只统计排队后取得额度的请求
+func (server *Server) wait(ctx context.Context, l *limiter) error {
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	default:
+	}
+	select {
+	case l.waiting <- struct{}{}:
+	default:
+		server.metrics.concurrencyRejected.Add(1)
+		return errServerBusy
+	}
+	defer func() { <-l.waiting }()
+
+	start := time.Now()
+	select {
+	case l.slots <- struct{}{}:
+		server.metrics.queued.Add(1)
+		server.metrics.queueWait.Add(int64(time.Since(start)))
+		return nil
+	case <-ctx.Done():
+		return waitError(ctx)
+	}
+}
+
+// waitError 等待额度期间 ctx 结束时的错误
+func waitError(ctx context.Context) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return status.Error(codes.DeadlineExceeded, "rpc server: request deadline exceeded while queued")
+	}
+	return status.Error(codes.Canceled, "rpc server: request canceled while queued")
+}
+
+// release 释放连接的并发额度
+func (c *serverConn) release() {
+	if c.slots != nil {
+		<-c.slots
+	}
+}
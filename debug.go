@@ -10,16 +10,34 @@ import (
 const debugText = `<html>
 	<body>
 	<title>GeeRPC Services</title>
-	{{range .}}
+	<hr>
+	Limits
+	<hr>
+		<table>
+		<tr><td>HeaderTooLarge</td><td align=center>{{.Metrics.HeaderTooLarge}}</td></tr>
+		<tr><td>BodyTooLarge</td><td align=center>{{.Metrics.BodyTooLarge}}</td></tr>
+		<tr><td>FrameTooLarge</td><td align=center>{{.Metrics.FrameTooLarge}}</td></tr>
+		<tr><td>HandshakeTimeouts</td><td align=center>{{.Metrics.HandshakeTimeouts}}</td></tr>
+		<tr><td>IdleTimeouts</td><td align=center>{{.Metrics.IdleTimeouts}}</td></tr>
+		<tr><td>InflightRejected</td><td align=center>{{.Metrics.InflightRejected}}</td></tr>
+		<tr><td>ConnPaused</td><td align=center>{{.Metrics.ConnPaused}}</td></tr>
+		<tr><td>ConnQueued</td><td align=center>{{.Metrics.ConnQueued}}</td></tr>
+		<tr><td>ConnQueueWait</td><td align=center>{{.Metrics.ConnQueueWait}}</td></tr>
+		<tr><td>ConcurrencyRejected</td><td align=center>{{.Metrics.ConcurrencyRejected}}</td></tr>
+		<tr><td>Queued</td><td align=center>{{.Metrics.Queued}}</td></tr>
+		<tr><td>QueueWait</td><td align=center>{{.Metrics.QueueWait}}</td></tr>
+		</table>
+	{{range .Services}}
 	<hr>
 	Service {{.Name}}
 	<hr>
 		<table>
-		<th align=center>Method</th><th align=center>Calls</th>
+		<th align=center>Method</th><th align=center>Calls</th><th align=center>Panics</th>
 		{{range $name, $mtype := .Method}}
 			<tr>
-			<td align=left font=fixed>{{$name}}({{$mtype.ArgType}}, {{$mtype.ReplyType}}) error</td>
+			<td align=left font=fixed>{{$name}}({{if $mtype.HasContext}}context.Context, {{end}}{{$mtype.ArgType}}, {{$mtype.ReplyType}}) error</td>
 			<td align=center>{{$mtype.NumCalls}}</td>
+			<td align=center>{{$mtype.NumPanics}}</td>
 			</tr>
 		{{end}}
 		</table>
@@ -49,7 +67,10 @@ func (server DebugHTTP) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		})
 		return true
 	})
-	err := debug.Execute(w, services)
+	err := debug.Execute(w, struct {
+		Services []DebugService
+		Metrics  Metrics
+	}{services, server.Metrics()})
 	if err != nil {
 		_, _ = fmt.Fprintln(w, "rpc: error executing template:", err.Error())
 	}
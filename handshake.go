@@ -0,0 +1,464 @@
+package myGoRPC
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"myGoRPC/codec"
+	"myGoRPC/codes"
+	"myGoRPC/status"
+	"sync"
+	"time"
+)
+
+/*
+握手
+
+客户端连接建立后首先发送 hello，服务端回复 ack，之后才开始收发 RPC 消息：
+
+	hello:
+	| magic uint32 | version uint8 | flags uint8 | reserved uint16 |
+	| connectTimeout int64 | handleTimeout int64 | compressThreshold uint32 |
+	| codec count uint8 | codec len uint8 | codec ... | compress len uint8 | compress |
+	| token len uint16 | token |                   （仅当 flags 含 handshakeFlagToken）
+
+	ack:
+	| magic uint32 | version uint8 | status uint8 | flags uint8 |
+	| codec len uint8 | codec | compress len uint8 | compress | message len uint16 | message |
+
+magic 即 RpcNumber，整数均为大端序，超时单位为纳秒（与 time.Duration 一致）；
+codec 为按偏好排序的候选 Codec，ack 中为服务端的选择。
+flags 为客户端请求的特性（handshakeFlagFraming 等），ack 中为服务端实际启用的特性。
+token 为连接的凭证（Option.Token），由 Server.Authenticator 验证，失败时回复 handshakeUnauthenticated。
+status 不为 handshakeOK 时 message 说明原因，服务端随即关闭连接。
+
+旧版本的客户端发送 JSON 编码的 Option，首字节必然是 '{'（或空白），而 magic 的首字节为 0，
+服务端据此区分两种格式，JSON 握手在过渡期后移除
+*/
+const HandshakeVersion uint8 = 1
+
+const (
+	handshakeOK uint8 = iota
+	handshakeBadMagic
+	handshakeBadVersion
+	handshakeBadCodec
+	handshakeBadRequest
+	handshakeUnauthenticated
+)
+
+const helloFixedLen = 29
+
+const (
+	handshakeFlagFraming uint8 = 1 << iota // 分帧传输，见 codec.FrameCodec
+	handshakeFlagToken                     // hello 末尾携带 token，只出现在 hello 中
+)
+
+func (opt *Option) flags() (flags uint8) {
+	if opt.Framing {
+		flags |= handshakeFlagFraming
+	}
+	return
+}
+
+func (opt *Option) setFlags(flags uint8) {
+	opt.Framing = flags&handshakeFlagFraming != 0
+}
+
+var errBadMagic = errors.New("invalid rpc number")
+
+/*
+handshakeError
+ack 中 status 不为 handshakeOK 时，客户端得到的错误
+*/
+type handshakeError struct {
+	Status  uint8
+	Message string
+}
+
+func (e *handshakeError) Error() string {
+	return fmt.Sprintf("rpc handshake rejected (status %d): %s", e.Status, e.Message)
+}
+
+type ack struct {
+	Version   uint8
+	Status    uint8
+	Flags     uint8
+	CodecType codec.Type
+	Compress  codec.CompressType
+	Message   string
+}
+
+// offers 客户端提供的候选 Codec，未指定列表时即为 CodecType
+func (opt *Option) offers() []codec.Type {
+	if len(opt.CodecTypes) > 0 {
+		return opt.CodecTypes
+	}
+	return []codec.Type{opt.CodecType}
+}
+
+func writeHello(w io.Writer, opt *Option) error {
+	offers := opt.offers()
+	if len(offers) > 0xff {
+		return errors.New("too many codec types")
+	}
+	b := make([]byte, helloFixedLen, 64)
+	binary.BigEndian.PutUint32(b[0:], RpcNumber)
+	b[4] = HandshakeVersion
+	b[5] = opt.flags()
+	if opt.Token != "" {
+		b[5] |= handshakeFlagToken
+	}
+	binary.BigEndian.PutUint64(b[8:], uint64(opt.ConnectTimeout))
+	binary.BigEndian.PutUint64(b[16:], uint64(opt.HandleTimeout))
+	binary.BigEndian.PutUint32(b[24:], uint32(opt.CompressThreshold))
+	b[28] = uint8(len(offers))
+	var err error
+	for _, typ := range offers {
+		if b, err = appendString8(b, string(typ)); err != nil {
+			return err
+		}
+	}
+	if b, err = appendString8(b, string(opt.Compress)); err != nil {
+		return err
+	}
+	if opt.Token != "" {
+		if len(opt.Token) > 0xffff {
+			return errors.New("token too long")
+		}
+		b = binary.BigEndian.AppendUint16(b, uint16(len(opt.Token)))
+		b = append(b, opt.Token...)
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+/*
+readHello
+magic 不匹配时返回 errBadMagic；版本不一致时仍然返回 version，由调用方回复 handshakeBadVersion
+*/
+func readHello(r io.Reader) (*Option, uint8, error) {
+	b := make([]byte, helloFixedLen)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, 0, err
+	}
+	if binary.BigEndian.Uint32(b[0:]) != RpcNumber {
+		return nil, 0, errBadMagic
+	}
+	version := b[4]
+	if version != HandshakeVersion {
+		return nil, version, nil
+	}
+	opt := &Option{
+		RpcNumber:         RpcNumber,
+		ConnectTimeout:    time.Duration(binary.BigEndian.Uint64(b[8:])),
+		HandleTimeout:     time.Duration(binary.BigEndian.Uint64(b[16:])),
+		CompressThreshold: int(binary.BigEndian.Uint32(b[24:])),
+		CodecTypes:        make([]codec.Type, b[28]),
+	}
+	opt.setFlags(b[5])
+	for i := range opt.CodecTypes {
+		typ, err := readString8(r)
+		if err != nil {
+			return nil, version, err
+		}
+		opt.CodecTypes[i] = codec.Type(typ)
+	}
+	compress, err := readString8(r)
+	if err != nil {
+		return nil, version, err
+	}
+	opt.Compress = codec.CompressType(compress)
+	if b[5]&handshakeFlagToken != 0 {
+		var l [2]byte
+		if _, err = io.ReadFull(r, l[:]); err != nil {
+			return nil, version, err
+		}
+		token := make([]byte, binary.BigEndian.Uint16(l[:]))
+		if _, err = io.ReadFull(r, token); err != nil {
+			return nil, version, err
+		}
+		opt.Token = string(token)
+	}
+	return opt, version, nil
+}
+
+func writeAck(w io.Writer, a *ack) error {
+	b := make([]byte, 7, 64)
+	binary.BigEndian.PutUint32(b[0:], RpcNumber)
+	b[4], b[5], b[6] = a.Version, a.Status, a.Flags
+	var err error
+	if b, err = appendString8(b, string(a.CodecType)); err != nil {
+		return err
+	}
+	if b, err = appendString8(b, string(a.Compress)); err != nil {
+		return err
+	}
+	if len(a.Message) > 0xffff {
+		a.Message = a.Message[:0xffff]
+	}
+	b = binary.BigEndian.AppendUint16(b, uint16(len(a.Message)))
+	b = append(b, a.Message...)
+	_, err = w.Write(b)
+	return err
+}
+
+func readAck(r io.Reader) (*ack, error) {
+	b := make([]byte, 7)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	if binary.BigEndian.Uint32(b[0:]) != RpcNumber {
+		return nil, errBadMagic
+	}
+	a := &ack{Version: b[4], Status: b[5], Flags: b[6]}
+	typ, err := readString8(r)
+	if err != nil {
+		return nil, err
+	}
+	compress, err := readString8(r)
+	if err != nil {
+		return nil, err
+	}
+	var l [2]byte
+	if _, err = io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err = io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	a.CodecType, a.Compress, a.Message = codec.Type(typ), codec.CompressType(compress), string(msg)
+	return a, nil
+}
+
+func appendString8(b []byte, s string) ([]byte, error) {
+	if len(s) > 0xff {
+		return nil, fmt.Errorf("handshake field too long: %q", s)
+	}
+	return append(append(b, uint8(len(s))), s...), nil
+}
+
+func readString8(r io.Reader) (string, error) {
+	var l [1]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return "", err
+	}
+	s := make([]byte, l[0])
+	if _, err := io.ReadFull(r, s); err != nil {
+		return "", err
+	}
+	return string(s), nil
+}
+
+// ----------------- 服务端握手 --------------
+
+var legacyOnce sync.Once
+
+/*
+handshake
+根据首字节区分二进制握手与旧版 JSON Option，返回协商后的 Option，
+以及 Codec 应当读写的连接（包含握手阶段预读的数据）；
+ctx 为连接的 context，客户端通过认证（见 authenticateConn）时返回携带 auth.Principal 的派生
+*/
+func (server *Server) handshake(ctx context.Context, conn io.ReadWriteCloser) (context.Context, *Option, io.ReadWriteCloser, error) {
+	br := bufio.NewReader(conn)
+	first, err := br.Peek(1)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	switch first[0] {
+	case '{', ' ', '\t', '\r', '\n':
+		legacyOnce.Do(func() {
+			log.Println("rpc server: JSON option handshake is deprecated, upgrade clients to the binary handshake")
+		})
+		return server.legacyHandshake(ctx, conn, br)
+	}
+
+	opt, version, err := readHello(br)
+	reply := &ack{Version: HandshakeVersion}
+	switch {
+	case err == errBadMagic:
+		reply.Status, reply.Message = handshakeBadMagic, "rpc server: invalid rpc number"
+	case err != nil:
+		return nil, nil, nil, err
+	case version != HandshakeVersion:
+		reply.Status = handshakeBadVersion
+		reply.Message = fmt.Sprintf("rpc server: unsupported handshake version %d, want %d", version, HandshakeVersion)
+	default:
+		if n := negotiate(opt); n.Error != "" {
+			reply.Status, reply.Message = handshakeBadCodec, n.Error
+		} else if ctx, err = server.authenticateConn(ctx, opt.Token); err != nil {
+			reply.Status, reply.Message = handshakeUnauthenticated, status.Convert(err).Message()
+		} else {
+			reply.CodecType, reply.Compress, reply.Flags = n.CodecType, n.Compress, opt.flags()
+		}
+	}
+	if werr := writeAck(conn, reply); werr != nil {
+		return nil, nil, nil, werr
+	}
+	if reply.Status != handshakeOK {
+		return nil, nil, nil, errors.New(reply.Message)
+	}
+	return ctx, opt, &bufferedConn{r: br, ReadWriteCloser: conn}, nil
+}
+
+// maxLegacyOptionSize 旧版 JSON Option 的大小上限
+const maxLegacyOptionSize = 64 << 10
+
+/*
+legacyHandshake
+旧版握手：JSON 编码的 Option，仅在需要协商时回复 negotiation；
+认证失败时没有回复，直接关闭连接
+*/
+func (server *Server) legacyHandshake(ctx context.Context, conn io.ReadWriteCloser, br *bufio.Reader) (context.Context, *Option, io.ReadWriteCloser, error) {
+	var opt Option
+	dec := json.NewDecoder(io.LimitReader(br, maxLegacyOptionSize))
+	if err := dec.Decode(&opt); err != nil {
+		return nil, nil, nil, fmt.Errorf("options decode error: %w", err)
+	}
+	if opt.RpcNumber != RpcNumber {
+		return nil, nil, nil, fmt.Errorf("invalid rpc number %x", opt.RpcNumber)
+	}
+	ctx, err := server.authenticateConn(ctx, opt.Token)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if opt.negotiable() {
+		reply := negotiate(&opt)
+		if err := json.NewEncoder(conn).Encode(reply); err != nil {
+			return nil, nil, nil, err
+		}
+		if reply.Error != "" {
+			return nil, nil, nil, errors.New(reply.Error)
+		}
+	}
+	if opt.newCodecFunc(codec.Limits{}) == nil {
+		return nil, nil, nil, fmt.Errorf("invalid codec type %s", opt.CodecType)
+	}
+	// json.Decoder 可能多读了紧随 Option 之后的 header，需要把这部分数据交还给 Codec
+	return ctx, &opt, newBufferedConn(conn, br, dec), nil
+}
+
+/*
+negotiation
+旧版 JSON 握手中，服务端对 Option.CodecTypes、Option.Compress 的回复，
+Error 不为空表示协商失败，连接随即关闭
+*/
+type negotiation struct {
+	CodecType codec.Type
+	Compress  codec.CompressType `json:",omitempty"`
+	Error     string
+}
+
+/*
+negotiate
+按客户端的偏好选出第一个支持的 Codec；压缩算法、分帧不支持时退化为不压缩、不分帧。
+opt 被更新为协商后的结果
+*/
+func negotiate(opt *Option) *negotiation {
+	var reply negotiation
+	if len(opt.CodecTypes) > 0 {
+		typ, ok := codec.Negotiate(opt.CodecTypes)
+		if !ok {
+			reply.Error = fmt.Sprintf("rpc server: no acceptable codec in %v", opt.CodecTypes)
+			return &reply
+		}
+		opt.CodecType = typ
+	} else if codec.Get(opt.CodecType) == nil {
+		reply.Error = fmt.Sprintf("rpc server: invalid codec type %s", opt.CodecType)
+		return &reply
+	}
+	if codec.GetCompressor(opt.Compress) == nil {
+		opt.Compress = codec.CompressNone
+	}
+	if codec.GetSerializer(opt.CodecType) == nil {
+		opt.Framing = false
+	}
+	reply.CodecType, reply.Compress = opt.CodecType, opt.Compress
+	return &reply
+}
+
+/*
+bufferedConn
+读取时先消费握手阶段预读的数据，写入与关闭仍然交给原连接。
+skipNewline 为 true 时（JSON 握手），json.Encoder 在值之后追加的换行符会在首次读取时被丢弃，
+避免被 Codec 当作数据（首次 Read 时才检查，避免在对方发送数据之前阻塞）
+*/
+type bufferedConn struct {
+	r           *bufio.Reader
+	skipNewline bool
+	io.ReadWriteCloser
+}
+
+func newBufferedConn(conn io.ReadWriteCloser, r io.Reader, dec *json.Decoder) *bufferedConn {
+	return &bufferedConn{
+		r:               bufio.NewReader(io.MultiReader(dec.Buffered(), r)),
+		skipNewline:     true,
+		ReadWriteCloser: conn,
+	}
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	if c.skipNewline {
+		c.skipNewline = false
+		if b, err := c.r.Peek(1); err == nil && b[0] == '\n' {
+			_, _ = c.r.Discard(1)
+		}
+	}
+	return c.r.Read(p)
+}
+
+// ----------------- 客户端握手 --------------
+
+/*
+clientHandshake
+发送 hello 并等待 ack，opt 被更新为协商后的结果。
+ack 按字段长度精确读取，不会多读服务端之后发送的数据，Codec 可以直接使用 conn
+*/
+func clientHandshake(conn io.ReadWriter, opt *Option) error {
+	if err := writeHello(conn, opt); err != nil {
+		return err
+	}
+	a, err := readAck(conn)
+	if err != nil {
+		return err
+	}
+	if a.Status == handshakeUnauthenticated {
+		return status.Error(codes.Unauthenticated, a.Message)
+	}
+	if a.Status != handshakeOK {
+		return &handshakeError{Status: a.Status, Message: a.Message}
+	}
+	opt.CodecType, opt.Compress = a.CodecType, a.Compress
+	opt.setFlags(a.Flags)
+	return nil
+}
+
+/*
+legacyClientHandshake
+旧版 JSON 握手，用于连接尚未升级的服务端，返回 Codec 应当读写的连接
+*/
+func legacyClientHandshake(conn io.ReadWriteCloser, opt *Option) (io.ReadWriteCloser, error) {
+	opt.Framing = false
+	if err := json.NewEncoder(conn).Encode(opt); err != nil {
+		return nil, err
+	}
+	if !opt.negotiable() {
+		return conn, nil
+	}
+	var reply negotiation
+	dec := json.NewDecoder(conn)
+	if err := dec.Decode(&reply); err != nil {
+		return nil, err
+	}
+	if reply.Error != "" {
+		return nil, errors.New(reply.Error)
+	}
+	opt.CodecType, opt.Compress = reply.CodecType, reply.Compress
+	return newBufferedConn(conn, conn, dec), nil
+}
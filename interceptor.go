@@ -0,0 +1,97 @@
+package myGoRPC
+
+import (
+	"context"
+	"myGoRPC/metadata"
+)
+
+/*
+ServerInfo
+拦截器可见的调用信息
+*/
+type ServerInfo struct {
+	Service  string
+	Method   string
+	Metadata metadata.MD // 请求 header 中的 Metadata，只读
+}
+
+/*
+Handler
+执行调用：args 为方法的入参，reply 为方法写入结果的指针
+*/
+type Handler func(ctx context.Context, args, reply interface{}) error
+
+/*
+ServerInterceptor
+服务端拦截器，包裹每一次方法调用，用于日志、鉴权、统计、panic 处理等；
+调用 next 继续执行后续拦截器以及方法本身，不调用 next 直接返回错误即为短路，错误通过 header.Error 回复给客户端
+*/
+type ServerInterceptor func(ctx context.Context, info *ServerInfo, args, reply interface{}, next Handler) error
+
+/*
+Use
+按顺序追加拦截器，先追加的在外层；应在 Accept 之前调用
+*/
+func (server *Server) Use(interceptors ...ServerInterceptor) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.interceptors = append(server.interceptors, interceptors...)
+}
+
+/*
+call
+经过拦截器链调用 req 对应的方法；方法总是使用 req.argV、req.replyV，
+拦截器可以通过 args、reply 指针读写，但替换 args、reply 不会生效。
+拦截器 panic 时与方法 panic 相同，恢复后返回 *service.PanicError 并计入方法的 NumPanic
+*/
+func (server *Server) call(ctx context.Context, req *request) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = req.svc.RecordPanic(req.mtype, r)
+		}
+	}()
+	server.mu.Lock()
+	interceptors := server.interceptors
+	server.mu.Unlock()
+
+	var h Handler = func(ctx context.Context, args, reply interface{}) error {
+		return req.svc.CallContext(ctx, req.mtype, req.argV, req.replyV)
+	}
+	info := &ServerInfo{
+		Service:  req.header.Service,
+		Method:   req.header.Method,
+		Metadata: req.header.Metadata,
+	}
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], h
+		h = func(ctx context.Context, args, reply interface{}) error {
+			return interceptor(ctx, info, args, reply, next)
+		}
+	}
+	return h(ctx, req.argV.Interface(), req.replyV.Interface())
+}
+
+/*
+Invoker
+发送一次调用并等待结果
+*/
+type Invoker func(ctx context.Context, service, method string, args, reply interface{}) error
+
+/*
+ClientInterceptor
+客户端拦截器，通过 Option.Interceptors 配置，包裹 Client.Call 与 Client.Go（XClient 的调用同样经过），
+用于注入 Metadata、日志、统计耗时、重试或者 mock；调用 invoker 发送请求，不调用即为短路
+*/
+type ClientInterceptor func(ctx context.Context, service, method string, args, reply interface{}, invoker Invoker) error
+
+// intercept 经过 Option.Interceptors 调用 invoker，先配置的在外层
+func (client *Client) intercept(ctx context.Context, service, method string, args, reply interface{}, invoker Invoker) error {
+	interceptors := client.option.Interceptors
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], invoker
+		invoker = func(ctx context.Context, service, method string, args, reply interface{}) error {
+			return interceptor(ctx, service, method, args, reply, next)
+		}
+	}
+	return invoker(ctx, service, method, args, reply)
+}
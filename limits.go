@@ -0,0 +1,150 @@
+package myGoRPC
+
+import (
+	"errors"
+	"io"
+	"log"
+	"myGoRPC/codec"
+	"myGoRPC/codes"
+	"myGoRPC/status"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultHandshakeTimeout = 10 * time.Second
+	DefaultMaxHeaderSize    = 64 << 10
+)
+
+// errTooManyInflight 连接上正在处理的请求达到 Server.MaxInflight 时，新请求收到的错误
+var errTooManyInflight = status.Error(codes.ResourceExhausted, "rpc server: too many in-flight requests on the connection")
+
+/*
+Metrics
+服务端各项限制的统计：拒绝请求、关闭连接、排队的次数，见 Server.Metrics
+*/
+type Metrics struct {
+	HeaderTooLarge    uint64 // header 超出 MaxHeaderSize，连接被关闭
+	BodyTooLarge      uint64 // body 超出 MaxBodySize
+	FrameTooLarge     uint64 // 压缩连接上一帧压缩前或解压后超出限制，连接被关闭，见 codec.LimitCompressed
+	HandshakeTimeouts uint64 // 没有在 HandshakeTimeout 内完成握手
+	IdleTimeouts      uint64 // 超出 IdleTimeout 被关闭的空闲连接
+	InflightRejected  uint64 // 超出 MaxInflight 被拒绝的请求
+	// 以下见 concurrency.go
+	ConnPaused          uint64        // 连接上等待的请求达到 ConnQueueSize 而暂停读取的次数
+	ConnQueued          uint64        // 因连接达到 MaxConnConcurrency 而开始等待的请求，包括之后被取消的
+	ConnQueueWait       time.Duration // 等待连接额度并取得额度的总时间
+	ConcurrencyRejected uint64        // 达到 MaxConcurrency 且队列已满，或者有客户端流的连接无法暂停时被拒绝的请求
+	Queued              uint64        // 排队等待后取得额度的请求，排队期间超时、取消的不计入
+	QueueWait           time.Duration // 排队等待的总时间，除以 Queued 即平均等待时间
+}
+
+type serverMetrics struct {
+	headerTooLarge    atomic.Uint64
+	bodyTooLarge      atomic.Uint64
+	frameTooLarge     atomic.Uint64
+	handshakeTimeouts atomic.Uint64
+	idleTimeouts      atomic.Uint64
+	inflightRejected  atomic.Uint64
+
+	connPaused          atomic.Uint64
+	connQueued          atomic.Uint64
+	connQueueWait       atomic.Int64
+	concurrencyRejected atomic.Uint64
+	queued              atomic.Uint64
+	queueWait           atomic.Int64
+}
+
+// Metrics 返回各项限制的统计，计数从 Server 创建开始累计
+func (server *Server) Metrics() Metrics {
+	m := &server.metrics
+	return Metrics{
+		HeaderTooLarge:    m.headerTooLarge.Load(),
+		BodyTooLarge:      m.bodyTooLarge.Load(),
+		FrameTooLarge:     m.frameTooLarge.Load(),
+		HandshakeTimeouts: m.handshakeTimeouts.Load(),
+		IdleTimeouts:      m.idleTimeouts.Load(),
+		InflightRejected:  m.inflightRejected.Load(),
+
+		ConnPaused:          m.connPaused.Load(),
+		ConnQueued:          m.connQueued.Load(),
+		ConnQueueWait:       time.Duration(m.connQueueWait.Load()),
+		ConcurrencyRejected: m.concurrencyRejected.Load(),
+		Queued:              m.queued.Load(),
+		QueueWait:           time.Duration(m.queueWait.Load()),
+	}
+}
+
+// limits 读取消息时的大小限制，超出时计入 Metrics
+func (server *Server) limits() codec.Limits {
+	return codec.Limits{
+		MaxHeaderSize: server.MaxHeaderSize,
+		MaxBodySize:   server.MaxBodySize,
+		Exceeded: func(err error) {
+			if errors.Is(err, codec.ErrHeaderTooLarge) {
+				server.metrics.headerTooLarge.Add(1)
+			} else if errors.Is(err, codec.ErrFrameTooLarge) {
+				server.metrics.frameTooLarge.Add(1)
+			} else {
+				server.metrics.bodyTooLarge.Add(1)
+			}
+		},
+	}
+}
+
+/*
+handshakeDeadline
+conn 支持 SetDeadline 时（net.Conn）为握手设置截止时间，返回清除截止时间的函数；
+对方连接后不发送数据时，握手不会一直等待下去
+*/
+func (server *Server) handshakeDeadline(conn io.ReadWriteCloser) func() {
+	d, ok := conn.(interface{ SetDeadline(time.Time) error })
+	if !ok || server.HandshakeTimeout <= 0 {
+		return func() {}
+	}
+	_ = d.SetDeadline(time.Now().Add(server.HandshakeTimeout))
+	return func() { _ = d.SetDeadline(time.Time{}) }
+}
+
+// handshakeFailed 统计超时导致的握手失败
+func (server *Server) handshakeFailed(err error) {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		server.metrics.handshakeTimeouts.Add(1)
+	}
+}
+
+/*
+watchIdle
+设置了 Server.IdleTimeout 时开始计算连接的空闲时间，返回停止计时的函数。
+收到消息、最后一个请求处理完成时重新计时；到期时仍有正在处理的请求则忽略，否则关闭连接
+*/
+func (c *serverConn) watchIdle(server *Server) func() {
+	if server.IdleTimeout <= 0 {
+		return func() {}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.timeout = server.IdleTimeout
+	c.idle = time.AfterFunc(c.timeout, func() {
+		c.mu.Lock()
+		busy := c.active > 0
+		c.mu.Unlock()
+		if busy {
+			return
+		}
+		server.metrics.idleTimeouts.Add(1)
+		log.Println("rpc server: closing idle connection after", c.timeout)
+		_ = c.close()
+	})
+	return func() { c.idle.Stop() }
+}
+
+// touch 连接上有新的消息，重新开始计算空闲时间
+func (c *serverConn) touch() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.idle != nil {
+		c.idle.Reset(c.timeout)
+	}
+}
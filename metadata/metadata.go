@@ -0,0 +1,81 @@
+package metadata
+
+import "context"
+
+/*
+MD
+请求范围的键值对，随 codec.Header.Metadata 在客户端与服务端之间传递，
+例如鉴权 token、trace ID、租户 ID
+*/
+type MD map[string]string
+
+// Pairs 由 k1, v1, k2, v2... 构造 MD，参数个数为奇数时最后一个 key 的值为空
+func Pairs(kv ...string) MD {
+	md := make(MD, len(kv)/2)
+	for i := 0; i < len(kv); i += 2 {
+		if i+1 < len(kv) {
+			md[kv[i]] = kv[i+1]
+		} else {
+			md[kv[i]] = ""
+		}
+	}
+	return md
+}
+
+func (md MD) Get(key string) string {
+	return md[key]
+}
+
+func (md MD) Copy() MD {
+	out := make(MD, len(md))
+	for k, v := range md {
+		out[k] = v
+	}
+	return out
+}
+
+// Join 合并多个 MD，后面的覆盖前面的同名 key
+func Join(mds ...MD) MD {
+	out := MD{}
+	for _, md := range mds {
+		for k, v := range md {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+type outgoingKey struct{}
+type incomingKey struct{}
+
+/*
+NewOutgoingContext
+客户端：Client.Call 会把 ctx 中的 MD 写入请求的 header
+*/
+func NewOutgoingContext(ctx context.Context, md MD) context.Context {
+	return context.WithValue(ctx, outgoingKey{}, md)
+}
+
+// AppendToOutgoingContext 在 ctx 已有的 MD 基础上追加键值对，不修改原来的 MD
+func AppendToOutgoingContext(ctx context.Context, kv ...string) context.Context {
+	md, _ := FromOutgoingContext(ctx)
+	return NewOutgoingContext(ctx, Join(md, Pairs(kv...)))
+}
+
+func FromOutgoingContext(ctx context.Context) (MD, bool) {
+	md, ok := ctx.Value(outgoingKey{}).(MD)
+	return md, ok
+}
+
+/*
+NewIncomingContext
+服务端：由请求 header 中的 Metadata 构造，交给处理请求的方法
+*/
+func NewIncomingContext(ctx context.Context, md MD) context.Context {
+	return context.WithValue(ctx, incomingKey{}, md)
+}
+
+func FromIncomingContext(ctx context.Context) (MD, bool) {
+	md, ok := ctx.Value(incomingKey{}).(MD)
+	return md, ok
+}
@@ -0,0 +1,40 @@
+package peer
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+)
+
+/*
+Peer
+请求来自的连接，服务端放入每个请求的 context，处理请求时通过 FromContext 读取
+*/
+type Peer struct {
+	Addr net.Addr             // 客户端地址，无法得到时为 nil
+	TLS  *tls.ConnectionState // TLS 握手完成后的状态，明文连接为 nil
+}
+
+/*
+Certificate
+客户端证书链的第一个证书，即客户端的身份；
+只有服务端要求并验证客户端证书（tls.Config.ClientAuth）时才可信，没有时返回 nil
+*/
+func (p *Peer) Certificate() *x509.Certificate {
+	if p == nil || p.TLS == nil || len(p.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+	return p.TLS.PeerCertificates[0]
+}
+
+type peerKey struct{}
+
+func NewContext(ctx context.Context, p *Peer) context.Context {
+	return context.WithValue(ctx, peerKey{}, p)
+}
+
+func FromContext(ctx context.Context) (*Peer, bool) {
+	p, ok := ctx.Value(peerKey{}).(*Peer)
+	return p, ok
+}
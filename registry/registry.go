@@ -1,6 +1,7 @@
 package registry
 
 import (
+	"crypto/tls"
 	"log"
 	"net/http"
 	"sort"
@@ -93,24 +94,36 @@ func HandleHTTP() {
 }
 
 func Heartbeat(registry, addr string, duration time.Duration) {
+	heartbeat(&http.Client{}, registry, addr, duration)
+}
+
+/*
+HeartbeatTLS
+与 Heartbeat 相同，registry 为 https 地址，config 用于验证注册中心（以及提供客户端证书）；
+注册中心通过 http.ListenAndServeTLS 等方式提供 HTTPS
+*/
+func HeartbeatTLS(registry, addr string, duration time.Duration, config *tls.Config) {
+	heartbeat(&http.Client{Transport: &http.Transport{TLSClientConfig: config}}, registry, addr, duration)
+}
+
+func heartbeat(httpClient *http.Client, registry, addr string, duration time.Duration) {
 	if duration == 0 {
 		duration = defaultTimeout - time.Duration(1)*time.Minute
 	}
 
 	var err error
-	err = sendHeartbeat(registry, addr)
+	err = sendHeartbeat(httpClient, registry, addr)
 	go func() {
 		t := time.NewTicker(duration)
 		for err == nil {
 			<-t.C
-			err = sendHeartbeat(registry, addr)
+			err = sendHeartbeat(httpClient, registry, addr)
 		}
 	}()
 }
 
-func sendHeartbeat(registry, addr string) error {
+func sendHeartbeat(httpClient *http.Client, registry, addr string) error {
 	log.Println(addr, " send heart beat to registry ", registry)
-	httpClient := &http.Client{}
 	req, _ := http.NewRequest("POST", registry, nil)
 	req.Header.Set("GoRPC-Server", addr)
 	if _, err := httpClient.Do(req); err != nil {
@@ -1,13 +1,19 @@
 package myGoRPC
 
 import (
-	"encoding/json"
+	"context"
+	"crypto/tls"
 	"errors"
-	"fmt"
 	"io"
 	"log"
+	"myGoRPC/acl"
+	"myGoRPC/auth"
 	"myGoRPC/codec"
+	"myGoRPC/codes"
+	"myGoRPC/metadata"
+	"myGoRPC/peer"
 	"myGoRPC/service"
+	"myGoRPC/status"
 	"net"
 	"net/http"
 	"reflect"
@@ -21,18 +27,70 @@ const RpcNumber = 0x0312ff
 Option
 定义消息的编解码方式
 超时 0 即为无限制
+
+CodecTypes 为按偏好排序的候选 Codec，非空时由服务端协商并回复最终选择，CodecType 被忽略；
+Compress 非空时同样需要协商，服务端不支持该压缩算法时回复空值，连接不压缩；
+两者均为空时沿用 CodecType。
+
+Framing 为 true 时请求分帧传输（codec.FrameCodec），单条消息编解码失败不会影响整个连接，
+服务端不支持时退化为普通的流式 Codec；仅二进制握手支持。
+Dial 等函数默认启用分帧，即根据 Unframed 设置 Framing，Unframed 为 true 时使用流式 Codec
+
+默认使用二进制握手（见 handshake.go），LegacyHandshake 为 true 时发送旧版 JSON Option，
+旧版 JSON 握手只在需要协商时回复
+
+Interceptors 只在客户端生效，包裹 Client.Call 与 Client.Go（见 ClientInterceptor）
+
+TLSConfig 不为 nil 时客户端通过 TLS 连接（见 DialTLS），需要双向认证时在其中配置客户端证书；
+Token 为连接的凭证，握手时发送，由服务端的 Authenticator 验证
 */
 type Option struct {
-	RpcNumber      int // 标志， myGoRPC 请求
-	CodecType      codec.Type
-	ConnectTimeout time.Duration
-	HandleTimeout  time.Duration
+	RpcNumber         int // 标志， myGoRPC 请求
+	CodecType         codec.Type
+	CodecTypes        []codec.Type       `json:",omitempty"`
+	Compress          codec.CompressType `json:",omitempty"`
+	CompressThreshold int                `json:",omitempty"` // 消息达到该字节数才压缩，0 使用 codec.DefaultCompressThreshold
+	ConnectTimeout    time.Duration
+	HandleTimeout     time.Duration
+	Framing           bool                `json:"-"`
+	Unframed          bool                `json:"-"`
+	LegacyHandshake   bool                `json:"-"`
+	Interceptors      []ClientInterceptor `json:"-"`
+	StreamWindow      int                 `json:"-"` // 流量控制窗口，0 使用 DefaultStreamWindow
+	TLSConfig         *tls.Config         `json:"-"`
+	Token             string              `json:",omitempty"`
+}
+
+// negotiable 客户端是否需要等待服务端的协商结果
+func (opt *Option) negotiable() bool {
+	return len(opt.CodecTypes) > 0 || opt.Compress != codec.CompressNone
+}
+
+// newCodecFunc 根据（协商后的）Option 得到 Codec 构造函数，按需包装大小限制与压缩
+func (opt *Option) newCodecFunc(limits codec.Limits) codec.NewCodecFunc {
+	f := codec.Get(opt.CodecType)
+	if opt.Framing {
+		f = codec.Framed(opt.CodecType)
+	}
+	if f == nil {
+		return nil
+	}
+	if opt.Compress != codec.CompressNone {
+		c := codec.GetCompressor(opt.Compress)
+		if c == nil {
+			return nil
+		}
+		// 同时限制帧的长度与解压后的长度
+		return codec.LimitCompressed(f, c, opt.CompressThreshold, limits)
+	}
+	return codec.Limit(f, limits)
 }
 
 var DefaultOption = &Option{
 	RpcNumber:      RpcNumber,
 	CodecType:      codec.GobType,
 	ConnectTimeout: time.Second * 10,
+	Framing:        true,
 }
 
 /*
@@ -41,10 +99,44 @@ Server
 */
 type Server struct {
 	ServiceMap sync.Map
+	// MaxHandleTimeout 单个请求处理时间的上限，客户端的 HandleTimeout 与请求的截止时间都不能超过它，0 即为无限制
+	MaxHandleTimeout time.Duration
+	// 以下限制 0 即为无限制，NewServer 设置了 HandshakeTimeout 与 MaxHeaderSize 的默认值，见 limits.go
+	MaxHeaderSize    int           // 单个 header 的字节数，超出时关闭连接
+	MaxBodySize      int           // 单个 body 的字节数，超出时回复 codes.ResourceExhausted（分帧传输）或者关闭连接
+	HandshakeTimeout time.Duration // TLS 握手与 RPC 握手的时间
+	IdleTimeout      time.Duration // 没有正在处理的请求、也没有收到消息的时间，超出时关闭连接
+	MaxInflight      int           // 单个连接上正在处理的请求（包括流），超出时回复 codes.ResourceExhausted
+	// 同时执行的方法数（包括流），0 即为无限制，见 concurrency.go
+	MaxConcurrency     int // 整个服务端，达到时请求排队等待
+	QueueSize          int // 达到 MaxConcurrency 时最多排队的请求数，队列已满时回复 codes.ResourceExhausted；0 即不排队
+	MaxConnConcurrency int // 单个连接，达到时请求等待连接上的方法返回
+	ConnQueueSize      int // 达到 MaxConnConcurrency 时单个连接上最多等待的请求数，已满时暂停读取该连接；0 即达到时立即暂停
+	// Debug 为 true 时，方法 panic 的错误回复中包含调用栈，仅用于调试，避免向客户端泄露实现细节
+	Debug bool
+	// Authenticator 不为 nil 时每次调用都需要通过认证，见 authenticateConn、authorize
+	Authenticator auth.Authenticator
+	// RequireConnAuth 为 true 时握手必须携带凭证（Option.Token），否则连接在握手时被拒绝
+	RequireConnAuth bool
+	// ACL 不为 nil 时 authorize 按调用方（auth.Principal）检查权限，见 acl.Policy
+	ACL *acl.ACL
+
+	mu           sync.Mutex // 保护以下
+	inShutdown   bool
+	listeners    map[net.Listener]struct{}
+	conns        map[*serverConn]struct{}
+	interceptors []ServerInterceptor // 见 Use
+
+	metrics     serverMetrics
+	limiterOnce sync.Once
+	limiter     *limiter // 见 MaxConcurrency
 }
 
 func NewServer() *Server {
-	return &Server{}
+	return &Server{
+		HandshakeTimeout: DefaultHandshakeTimeout,
+		MaxHeaderSize:    DefaultMaxHeaderSize,
+	}
 }
 
 /*
@@ -52,13 +144,28 @@ Accept
 实现了 Accept 方式，net.Listener 作为参数，
 for 循环等待 socket 连接建立，
 并开启子协程处理，处理过程交给了 ServerConn 方法
+
+Shutdown、Close 会关闭 listen，此时 Accept 直接返回
 */
 func (server *Server) Accept(listen net.Listener) {
+	_ = server.serve(listen)
+}
+
+// serve 即 Accept，返回结束的原因：Shutdown、Close 之后为 ErrServerClosed，否则为 listen.Accept 的错误
+func (server *Server) serve(listen net.Listener) error {
+	if !server.trackListener(listen, true) {
+		_ = listen.Close()
+		return ErrServerClosed
+	}
+	defer server.trackListener(listen, false)
 	for {
 		conn, err := listen.Accept()
 		if err != nil {
+			if server.shuttingDown() {
+				return ErrServerClosed
+			}
 			log.Println("rpc server: accept error: ", err)
-			return
+			return err
 		}
 		go server.ServeConn(conn)
 	}
@@ -66,31 +173,36 @@ func (server *Server) Accept(listen net.Listener) {
 
 /*
 ServeConn
-首先使用 json.NewDecoder 反序列化得到 Option 实例，
-检查 RpcNumber 和 CodeType 的值是否正确。
+首先完成握手（handshake），得到协商后的 Option，
 然后根据 CodeType 得到对应的消息编解码器，
 接下来的处理交给 serverCodec
+
+握手支持两种格式：固定布局的二进制握手，以及即将废弃的 JSON Option
+
+conn 为 *tls.Conn 时（见 AcceptTLS）先完成 TLS 握手，连接的地址与 TLS 状态通过 peer.FromContext 交给方法；
+设置了 Authenticator 时，握手中的凭证不合法的连接在这里被拒绝；
+两次握手需要在 HandshakeTimeout 内完成
 */
 func (server *Server) ServeConn(conn io.ReadWriteCloser) {
 	defer func() {
 		_ = conn.Close()
 	}()
 
-	var opt Option
-	if err := json.NewDecoder(conn).Decode(&opt); err != nil {
-		log.Println("rpc server: options decode error: ", err)
-		return
-	}
-	if opt.RpcNumber != RpcNumber {
-		log.Printf("rpc server: invalid rpc number %x", opt.RpcNumber)
+	clearDeadline := server.handshakeDeadline(conn)
+	p, err := newPeer(conn)
+	if err != nil {
+		server.handshakeFailed(err)
+		log.Println("rpc server: tls handshake error: ", err)
 		return
 	}
-	f := codec.NewCodecFuncMap[opt.CodecType]
-	if f == nil {
-		log.Printf("rpc server: invalid codec type %s", opt.CodecType)
+	ctx, opt, rwc, err := server.handshake(peer.NewContext(context.Background(), p), conn)
+	if err != nil {
+		server.handshakeFailed(err)
+		log.Println("rpc server: handshake error: ", err)
 		return
 	}
-	server.serveCodec(f(conn), &opt)
+	clearDeadline()
+	server.serveCodec(ctx, opt.newCodecFunc(server.limits())(rwc), opt)
 }
 
 // 定义非法请求的回应
@@ -108,63 +220,289 @@ handleRequest 使用了协程并发执行请求
 处理请求是并发的，但是回复请求的报文必须是逐个发送的，并发容易导致多个回复报文交织在一起，客户端无法解析。在这里使用锁(sending)保证
 
 只有在 header 解析失败时，才终止循环
+
+ctx 的生命周期与连接一致，循环结束（客户端断开）时取消，所有请求的 context 都派生自它，
+携带连接的 peer.Peer 以及握手时认证的 auth.Principal；
+正在处理的请求记录在 inflight 中，收到 codec.KindCancel 时取消对应 Seq 的 context，
+客户端流的消息（codec.KindStreamMsg、codec.KindStreamEnd）同样按 Seq 交给对应的流；
+Shutdown 开始后（serverConn.add 返回 ErrServerClosed）不再处理新的请求，直接回复错误；
+MaxConnConcurrency、MaxConcurrency 的等待发生在处理请求的协程中（见 acquire），
+连接上等待的请求达到 ConnQueueSize 时读循环暂停，不再读取该连接（见 admit）
 */
-func (server *Server) serveCodec(cc codec.Codec, opt *Option) {
-	sending := new(sync.Mutex)
-	wg := new(sync.WaitGroup)
+func (server *Server) serveCodec(connCtx context.Context, cc codec.Codec, opt *Option) {
+	c := newServerConn(cc, server.MaxConnConcurrency, server.ConnQueueSize)
+	if !server.trackConn(c, true) {
+		_ = cc.Close()
+		return
+	}
+	defer server.trackConn(c, false)
+	defer c.watchIdle(server)()
+	sending := c.sending
+	ctx, cancel := context.WithCancel(connCtx)
+	calls := &inflight{
+		cancels:  make(map[uint64]context.CancelCauseFunc),
+		windows:  make(map[uint64]*window),
+		inbounds: make(map[uint64]*inbound),
+	}
 	for {
 		// 读取请求
-		req, err := server.readRequest(cc)
+		req, err := server.readRequest(ctx, cc)
+		c.touch()
 		if err != nil {
 			if req == nil {
 				break
 			}
-			req.header.Error = err.Error()
-			server.sendResponse(cc, req.header, invalidRequest, sending)
+			if req.ctx == nil {
+				server.replyError(cc, req.header, err, sending)
+				continue
+			}
+			if req.token == "" {
+				// 没有凭证时 authorize 不会访问 Authenticator，直接回复
+				if aerr := server.authorize(req); aerr != nil {
+					err = aerr
+				}
+				server.replyError(cc, req.header, err, sending)
+				continue
+			}
+			// 认证、权限的错误优先；与普通请求一样计入 MaxInflight，Shutdown 等待它回复
+			if aerr := c.add(server.MaxInflight); aerr != nil {
+				if aerr == errTooManyInflight {
+					server.metrics.inflightRejected.Add(1)
+				}
+				server.replyError(cc, req.header, aerr, sending)
+				continue
+			}
+			go func(req *request, err error) {
+				defer c.done()
+				if aerr := server.authorize(req); aerr != nil {
+					err = aerr
+				}
+				server.replyError(cc, req.header, err, sending)
+			}(req, err)
+			continue
+		}
+		if req.header.Kind == codec.KindStreamMsg {
+			// body 按流的消息类型读取，失败意味着数据流已经错位
+			if err = calls.receive(cc, req.header.Seq); err != nil {
+				break
+			}
+			continue
+		}
+		switch req.header.Kind {
+		case codec.KindCancel:
+			calls.cancel(req.header.Seq)
+			continue
+		case codec.KindStreamWindow:
+			calls.grant(req.header.Seq, req.header.Window)
+			continue
+		case codec.KindStreamEnd:
+			calls.closeSend(req.header.Seq)
+			continue
+		case codec.KindRequest, codec.KindStream, codec.KindNotify:
+		default:
+			// 不认识的控制消息，忽略
+			continue
+		}
+		if err = server.admit(c, calls.streaming()); err == ErrServerClosed {
+			break
+		} else if err != nil {
+			server.replyError(cc, req.header, err, sending)
+			continue
+		}
+		if err = c.add(server.MaxInflight); err != nil {
+			c.leave()
+			if err == errTooManyInflight {
+				server.metrics.inflightRejected.Add(1)
+			}
+			server.replyError(cc, req.header, err, sending)
 			continue
 		}
 		// 处理请求
-		wg.Add(1)
-		go server.handleRequest(cc, req, sending, wg, opt.HandleTimeout)
+		if req.mtype.ServerStream || req.mtype.ClientStream {
+			w := newWindow(req.header.Window)
+			var in *inbound
+			if req.mtype.ClientStream {
+				in = newInbound(req.mtype.ArgType.Elem(), req.header.Window)
+			}
+			req.ctx = calls.add(req.ctx, req.header.Seq, w, in)
+			go func(req *request) {
+				defer calls.cancel(req.header.Seq)
+				server.handleStream(cc, req, w, in, sending, c, opt.HandleTimeout)
+			}(req)
+			continue
+		}
+		if req.header.Kind == codec.KindNotify {
+			// 单向调用不能被取消，也没有 Seq
+			go server.handleRequest(cc, req, sending, c, opt.HandleTimeout)
+			continue
+		}
+		req.ctx = calls.add(req.ctx, req.header.Seq, nil, nil)
+		go func(req *request) {
+			defer calls.cancel(req.header.Seq)
+			server.handleRequest(cc, req, sending, c, opt.HandleTimeout)
+		}(req)
 	}
-	wg.Wait()
+	cancel()
+	c.wg.Wait()
 	cc.Close()
 }
 
+/*
+inflight
+一个连接上正在处理的请求，键为 Seq；流式调用还记录流量控制的窗口，客户端流记录尚未被方法接收的消息
+*/
+type inflight struct {
+	mu       sync.Mutex
+	cancels  map[uint64]context.CancelCauseFunc
+	windows  map[uint64]*window
+	inbounds map[uint64]*inbound
+}
+
+/*
+add
+返回可以通过 cancel(seq)、abort(seq) 取消的 ctx，
+w 不为 nil 时可以通过 grant(seq) 增加额度，in 不为 nil 时通过 receive(seq)、closeSend(seq) 接收客户端流
+*/
+func (f *inflight) add(ctx context.Context, seq uint64, w *window, in *inbound) context.Context {
+	ctx, cancel := context.WithCancelCause(ctx)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.cancels[seq] = cancel
+	if w != nil {
+		f.windows[seq] = w
+	}
+	if in != nil {
+		f.inbounds[seq] = in
+	}
+	return ctx
+}
+
+// streaming 是否有正在进行的客户端流，见 admit
+func (f *inflight) streaming() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.inbounds) > 0
+}
+
+// cancel 取消并移除 seq 对应的请求，请求不存在（已经处理完）时忽略
+func (f *inflight) cancel(seq uint64) {
+	f.abort(seq, nil)
+}
+
+// abort 与 cancel 相同，cause 不为 nil 时作为 context.Cause，流以该错误结束（见 cancelStream）
+func (f *inflight) abort(seq uint64, cause error) {
+	f.mu.Lock()
+	cancel := f.cancels[seq]
+	delete(f.cancels, seq)
+	delete(f.windows, seq)
+	delete(f.inbounds, seq)
+	f.mu.Unlock()
+	if cancel != nil {
+		cancel(cause)
+	}
+}
+
+// grant 处理 codec.KindStreamWindow，流不存在（已经结束）时忽略
+func (f *inflight) grant(seq uint64, n uint32) {
+	f.mu.Lock()
+	w := f.windows[seq]
+	f.mu.Unlock()
+	if w != nil {
+		w.grant(n)
+	}
+}
+
 type request struct {
 	header *codec.Header
+	ctx    context.Context // 派生自连接的 ctx，携带 header 中的 Metadata，见 metadata.FromIncomingContext
 	argV   reflect.Value
 	replyV reflect.Value
 	mtype  *service.MethodType
 	svc    *service.Service
+	// deadline 收到 header 的时间加上 header.Timeout，零值表示没有截止时间
+	deadline time.Time
+	token    string // 调用的凭证，见 authorize
 }
 
+/*
+readRequestHeader
+header 已完整读出但不合法时（codec.MessageError，例如 Metadata 超出限制），同时返回 header 与错误
+*/
 func (server *Server) readRequestHeader(cc codec.Codec) (*codec.Header, error) {
 	var h codec.Header
 	if err := cc.ReadHeader(&h); err != nil {
 		if err != io.EOF && err != io.ErrUnexpectedEOF {
 			log.Println("rpc server: read header error: ", err)
 		}
+		if codec.IsMessageError(err) {
+			return &h, err
+		}
 		return nil, err
 	}
 	return &h, nil
 }
 
-func (server *Server) readRequest(cc codec.Codec) (*request, error) {
+func (server *Server) readRequest(ctx context.Context, cc codec.Codec) (*request, error) {
 	h, err := server.readRequestHeader(cc)
+	arrival := time.Now()
 	if err != nil {
-		return nil, err
+		if h == nil {
+			return nil, err
+		}
+		_ = cc.ReadBody(nil)
+		return &request{header: h}, err
+	}
+	if h.Kind == codec.KindStreamMsg {
+		// 客户端流的消息，body 由 serveCodec 按流的消息类型读取
+		return &request{header: h}, nil
+	}
+	if h.Kind != codec.KindRequest && h.Kind != codec.KindStream && h.Kind != codec.KindNotify {
+		// 控制消息只有 header 有意义，丢弃 body
+		if err = cc.ReadBody(nil); err != nil {
+			return nil, err
+		}
+		return &request{header: h}, nil
+	}
+	// 先取出调用的凭证，Metadata 中不再包含它
+	token := server.callToken(h)
+	req := &request{
+		header: h,
+		token:  token,
+		ctx:    metadata.NewIncomingContext(ctx, h.Metadata),
+	}
+	if h.Timeout != 0 {
+		req.deadline = arrival.Add(time.Duration(h.Timeout))
 	}
-	req := &request{header: h}
 	//  请求参数尚未确定，假定为string
 
 	req.svc, req.mtype, err = server.findServiceMethod(h.Service, h.Method)
 	if err != nil {
+		// 丢弃 body，保证下一条消息从 header 开始
+		_ = cc.ReadBody(nil)
 		return req, err
 	}
+	if stream := h.Kind == codec.KindStream; stream != (req.mtype.ServerStream || req.mtype.ClientStream) {
+		_ = cc.ReadBody(nil)
+		if stream {
+			return req, status.Errorf(codes.InvalidArgument, "rpc server: %s.%s is not a streaming method", h.Service, h.Method)
+		}
+		return req, status.Errorf(codes.InvalidArgument, "rpc server: %s.%s is a streaming method, use Client.NewStream", h.Service, h.Method)
+	}
+	if h.Window > MaxStreamWindow {
+		// 客户端流的缓冲区按窗口分配，必须在分配之前拒绝
+		_ = cc.ReadBody(nil)
+		return req, status.Errorf(codes.InvalidArgument, "rpc server: stream window %d exceeds %d", h.Window, MaxStreamWindow)
+	}
 
 	req.argV = req.mtype.NewArgv()
 	req.replyV = req.mtype.NewReplyv()
+	if req.mtype.ClientStream {
+		// 参数随后通过 codec.KindStreamMsg 到达，打开流的请求没有参数
+		if err = cc.ReadBody(nil); err != nil {
+			return req, err
+		}
+		return req, server.checkDeadline(req)
+	}
 
 	// 确保 argvi 是 指针
 	argvi := req.argV.Interface()
@@ -176,82 +514,167 @@ func (server *Server) readRequest(cc codec.Codec) (*request, error) {
 		log.Println("rpc server: read argV err: ", err)
 		return req, err
 	}
-	return req, nil
+	return req, server.checkDeadline(req)
+}
+
+// checkDeadline 请求发送时已经过期，或者读取参数之后已经超过截止时间则返回错误
+func (server *Server) checkDeadline(req *request) error {
+	if req.header.Timeout < 0 || !req.deadline.IsZero() && !time.Now().Before(req.deadline) {
+		return status.Error(codes.DeadlineExceeded, "rpc server: request deadline exceeded on arrival")
+	}
+	return nil
 }
 
+/*
+sendResponse
+回复编码失败但连接仍然可用时（codec.MessageError），改为回复该 Seq 的错误，客户端不会一直等待
+*/
 func (server *Server) sendResponse(cc codec.Codec, header *codec.Header, body interface{}, sending *sync.Mutex) {
 	sending.Lock()
 	defer sending.Unlock()
-	if err := cc.Write(header, body); err != nil {
+	// 回复复用请求的 header，Metadata 不需要再发回客户端
+	header.Metadata = nil
+	header.Timeout = 0
+	err := cc.Write(header, body)
+	if err != nil && codec.IsMessageError(err) && body != invalidRequest {
+		server.setStatus(header, status.Error(codes.Internal, "rpc server: encode reply error: "+err.Error()))
+		err = cc.Write(header, invalidRequest)
+	}
+	if err != nil {
 		log.Println("rpc server: write response error: ", err)
 	}
 }
 
+// replyError 回复请求的错误，打开流的请求以 codec.KindStreamEnd 回复，单向调用只记录日志
+func (server *Server) replyError(cc codec.Codec, h *codec.Header, err error, sending *sync.Mutex) {
+	if h.Kind == codec.KindNotify {
+		log.Printf("rpc server: notify %s.%s error: %v", h.Service, h.Method, err)
+		return
+	}
+	server.setStatus(h, err)
+	if h.Kind == codec.KindStream {
+		h.Kind = codec.KindStreamEnd
+	}
+	server.sendResponse(cc, h, invalidRequest, sending)
+}
+
+/*
+setStatus
+把 err 转换为 status.Status 写入回复的 header；没有错误码的 error 按来源映射：
+方法 panic 为 codes.Internal（Debug 为 true 时附带调用栈），Metadata、body 超出限制为 codes.ResourceExhausted，
+其他单条消息的编解码错误为 codes.InvalidArgument，方法返回的普通 error 为 codes.Unknown
+*/
+func (server *Server) setStatus(h *codec.Header, err error) {
+	s, ok := status.FromError(err)
+	if !ok {
+		var perr *service.PanicError
+		switch {
+		case errors.As(err, &perr):
+			msg := err.Error()
+			if server.Debug {
+				msg += "\n" + string(perr.Stack)
+			}
+			s = status.New(codes.Internal, msg)
+		case errors.Is(err, codec.ErrMetadataTooLarge), errors.Is(err, codec.ErrBodyTooLarge):
+			s = status.New(codes.ResourceExhausted, err.Error())
+		case codec.IsMessageError(err):
+			s = status.New(codes.InvalidArgument, err.Error())
+		}
+	}
+	h.Error = s.Message()
+	h.Code = uint32(s.Code())
+	h.Details = s.Details()
+}
+
 /*
 handleRequest
-调用相应 rpc 方法，写入 req.replyV
+经过拦截器链（见 Use）调用相应 rpc 方法，写入 req.replyV
 而后调用 sendResponse
 
-加入超时处理
+加入超时处理，截止时间见 handleContext
+
+方法的第一个入参为 context.Context 时传入 req.ctx 的派生，
+超时、客户端断开或者 handleRequest 返回后被取消
+
+每个请求只回复一次，且只由 handleRequest 回复：
+方法在独立的协程中执行，结果写入带缓冲的 done，超时后即使方法才返回也不会阻塞，
+迟到的 replyV 直接丢弃；客户端断开或者取消调用（codec.KindCancel）时不再回复；
+单向调用（codec.KindNotify）从不回复，错误只记录日志
 */
-func (server *Server) handleRequest(cc codec.Codec, req *request, sending *sync.Mutex, wg *sync.WaitGroup, timeout time.Duration) {
-	// 应调用相应rpc方法，获取replyV，暂时只print参数
-	defer wg.Done()
-	called := make(chan struct{})
-	sent := make(chan struct{})
-
-	//// 加上 context 告知子协程退出
-	//ctx, cancel := context.WithCancel(context.Background())
-	//defer cancel()
-	//
-	//go func(ctx context.Context) {
-	//	err := req.svc.Call(req.mtype, req.argV, req.replyV)
-	//	called <- struct{}{}
-	//
-	//	if err != nil {
-	//		req.header.Error = err.Error()
-	//		server.sendResponse(cc, req.header, invalidRequest, sending)
-	//		sent <- struct{}{}
-	//		return
-	//	}
-	//
-	//	server.sendResponse(cc, req.header, req.replyV.Interface(), sending)
-	//	sent <- struct{}{}
-	//	select {
-	//	case <-ctx.Done():
-	//		return
-	//	}
-	//}(ctx)
+func (server *Server) handleRequest(cc codec.Codec, req *request, sending *sync.Mutex, c *serverConn, timeout time.Duration) {
+	defer c.done()
+	defer c.leave()
+	if err := server.authorize(req); err != nil {
+		server.replyError(cc, req.header, err, sending)
+		return
+	}
 
+	ctx, cancel := server.handleContext(req, timeout)
+	defer cancel()
+	// 排队的时间同样计入处理时间；被取消的请求不再回复
+	release, err := server.acquire(ctx, c)
+	if err != nil {
+		if ctx.Err() != context.Canceled {
+			server.replyError(cc, req.header, err, sending)
+		}
+		return
+	}
+
+	done := make(chan error, 1)
 	go func() {
-		err := req.svc.Call(req.mtype, req.argV, req.replyV)
-		called <- struct{}{}
+		// 额度在方法真正返回时才释放，处理超时后仍在执行的方法继续占用额度
+		defer release()
+		done <- server.call(ctx, req)
+	}()
 
+	select {
+	case err := <-done:
+		if req.header.Kind == codec.KindNotify {
+			if err != nil {
+				server.replyError(cc, req.header, err, sending)
+			}
+			return
+		}
 		if err != nil {
-			req.header.Error = err.Error()
+			server.setStatus(req.header, err)
 			server.sendResponse(cc, req.header, invalidRequest, sending)
-			sent <- struct{}{}
 			return
 		}
-
 		server.sendResponse(cc, req.header, req.replyV.Interface(), sending)
-		sent <- struct{}{}
-	}()
-
-	if timeout == 0 {
-		<-called
-		<-sent
-		return
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			// 方法可能仍在执行并读取 req.header，回复使用副本
+			h := *req.header
+			server.replyError(cc, &h, status.Error(codes.DeadlineExceeded, "rpc server: request handle timeout"), sending)
+		}
 	}
+}
 
-	select {
-	case <-time.After(timeout):
-		// 如果在timeout后call才调用结束，但已经超时，直接返回，将不会接受called，存在goroutines泄露
-		req.header.Error = fmt.Sprintf("rpc server: request handle timeout")
-		server.sendResponse(cc, req.header, invalidRequest, sending)
-	case <-called:
-		<-sent
+/*
+handleContext
+方法的截止时间取以下最早者：连接的 HandleTimeout、请求的截止时间（见 request.deadline）、Server.MaxHandleTimeout
+*/
+func (server *Server) handleContext(req *request, timeout time.Duration) (context.Context, context.CancelFunc) {
+	var deadline time.Time
+	earliest := func(t time.Time) {
+		if deadline.IsZero() || t.Before(deadline) {
+			deadline = t
+		}
+	}
+	now := time.Now()
+	if timeout > 0 {
+		earliest(now.Add(timeout))
+	}
+	if !req.deadline.IsZero() {
+		earliest(req.deadline)
 	}
+	if server.MaxHandleTimeout > 0 {
+		earliest(now.Add(server.MaxHandleTimeout))
+	}
+	if deadline.IsZero() {
+		return context.WithCancel(req.ctx)
+	}
+	return context.WithDeadline(req.ctx, deadline)
 }
 
 // ------------------ 构建默认 server ----------------
@@ -270,23 +693,27 @@ func (server *Server) Register(rcvr interface{}) error {
 	return nil
 }
 
+/*
+findServiceMethod
+查找不到时的错误在 authorize 之后才回复（见 serveCodec），没有权限的调用方无法得知方法是否存在
+*/
 func (server *Server) findServiceMethod(serviceName, methodName string) (svc *service.Service, mtype *service.MethodType, err error) {
 	if serviceName == "" || methodName == "" {
-		err = errors.New("rpc server: serviceName/methodName request ill-formed: " + serviceName + "." + methodName)
+		err = status.Error(codes.InvalidArgument, "rpc server: serviceName/methodName request ill-formed: "+serviceName+"."+methodName)
 		return
 	}
 
 	svci, ok := server.ServiceMap.Load(serviceName)
 
 	if !ok {
-		err = errors.New("rpc server: can't find service " + serviceName)
+		err = status.Error(codes.NotFound, "rpc server: can't find service "+serviceName)
 		return
 	}
 
 	svc = svci.(*service.Service)
 	mtype = svc.Method[methodName]
 	if mtype == nil {
-		err = errors.New("rpc server: can't find method" + methodName)
+		err = status.Error(codes.NotFound, "rpc server: can't find method "+methodName)
 	}
 	return
 }
@@ -0,0 +1,608 @@
+package myGoRPC
+
+import (
+	"context"
+	"errors"
+	"myGoRPC/codec"
+	"myGoRPC/codes"
+	"myGoRPC/metadata"
+	"myGoRPC/service"
+	"myGoRPC/status"
+	"net"
+	"os"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+type Sleep int
+
+// Ignore 不理会 ctx，睡眠 d 后返回
+func (s Sleep) Ignore(d time.Duration, reply *int) error {
+	time.Sleep(d)
+	*reply = 1
+	return nil
+}
+
+// Honor 睡眠 d，或者在 ctx 取消时提前返回
+func (s Sleep) Honor(ctx context.Context, d time.Duration, reply *int) error {
+	select {
+	case <-time.After(d):
+		*reply = 1
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Cancel 阻塞直到 ctx 被取消，通过 sleepCanceled 报告取消原因
+var sleepCanceled = make(chan error, 1)
+
+func (s Sleep) Cancel(ctx context.Context, n int, reply *int) error {
+	<-ctx.Done()
+	sleepCanceled <- ctx.Err()
+	return ctx.Err()
+}
+
+// Deadline 返回方法收到的 ctx 的截止时间（Unix 纳秒）
+func (s Sleep) Deadline(ctx context.Context, n int, reply *int64) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		*reply = deadline.UnixNano()
+	}
+	return nil
+}
+
+func (s Sleep) Panic(n int, reply *int) error {
+	panic("boom")
+}
+
+// Deny 返回带有错误码与附加信息的错误
+func (s Sleep) Deny(user string, reply *int) error {
+	return status.New(codes.PermissionDenied, "denied "+user).WithDetails("role=guest").Err()
+}
+
+func startSleepServer(t *testing.T) string {
+	return startSleepServerWith(t, NewServer())
+}
+
+func startSleepServerWith(t *testing.T, server *Server) string {
+	_ = server.Register(new(Sleep))
+	l, err := net.Listen("tcp", ":0")
+	_assert(err == nil, "failed to listen: %v", err)
+	go server.Accept(l)
+	t.Cleanup(func() { _ = l.Close() })
+	return l.Addr().String()
+}
+
+/*
+测试处理超时后没有泄露协程。
+不调用 t.Parallel()，在并行的测试开始之前单独运行，协程数量不受其他测试干扰
+*/
+func TestServer_HandleTimeoutLeak(t *testing.T) {
+	addr := startSleepServer(t)
+	client, err := Dial("tcp", addr, &Option{HandleTimeout: time.Millisecond * 50})
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+
+	base := runtime.NumGoroutine()
+	for _, method := range []string{"Ignore", "Honor"} {
+		for i := 0; i < 10; i++ {
+			var reply int
+			err = client.Call(context.Background(), "Sleep", method, time.Millisecond*200, &reply)
+			_assert(err != nil && strings.Contains(err.Error(), "handle timeout"), "expect a timeout error, got %v", err)
+		}
+	}
+
+	deadline := time.Now().Add(time.Second * 2)
+	for runtime.NumGoroutine() > base && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 20)
+	}
+	_assert(runtime.NumGoroutine() <= base, "goroutine leak: %d before, %d after", base, runtime.NumGoroutine())
+}
+
+// dialCodec 完成握手后直接返回 Codec，用于构造 Client 不会发送的请求
+func dialCodec(t *testing.T, addr string, opt *Option) codec.Codec {
+	conn, err := net.Dial("tcp", addr)
+	_assert(err == nil, "failed to dial: %v", err)
+	o := *DefaultOption
+	o.HandleTimeout = opt.HandleTimeout
+	_assert(clientHandshake(conn, &o) == nil, "handshake failed")
+	cc := o.newCodecFunc(codec.Limits{})(conn)
+	t.Cleanup(func() { _ = cc.Close() })
+	return cc
+}
+
+/*
+测试处理超时后只回复一次。
+超时的方法稍后才返回，下一条回复仍然属于下一个请求
+*/
+func TestServer_HandleTimeoutReplyOnce(t *testing.T) {
+	t.Parallel()
+	addr := startSleepServer(t)
+	cc := dialCodec(t, addr, &Option{HandleTimeout: time.Millisecond * 50})
+
+	var h codec.Header
+	_assert(cc.Write(&codec.Header{Service: "Sleep", Method: "Ignore", Seq: 1}, time.Millisecond*100) == nil, "failed to write request")
+	_assert(cc.ReadHeader(&h) == nil && h.Seq == 1 && strings.Contains(h.Error, "handle timeout"), "expect a timeout error, got %+v", h)
+	_assert(cc.ReadBody(nil) == nil, "failed to read body")
+
+	// 等待 Sleep.Ignore 返回
+	time.Sleep(time.Millisecond * 200)
+	_assert(cc.Write(&codec.Header{Service: "Sleep", Method: "Ignore", Seq: 2}, time.Duration(0)) == nil, "failed to write request")
+	var reply int
+	_assert(cc.ReadHeader(&h) == nil && h.Seq == 2 && h.Error == "", "expect the reply of seq 2, got %+v", h)
+	_assert(cc.ReadBody(&reply) == nil && reply == 1, "expect 1, got %d", reply)
+}
+
+/*
+测试客户端取消调用。
+客户端 ctx 被取消后发送取消消息，服务端方法的 ctx 随之被取消，连接继续可用
+*/
+func TestServer_Cancel(t *testing.T) {
+	t.Parallel()
+	addr := startSleepServer(t)
+	client, err := Dial("tcp", addr)
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+
+	var reply int
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(time.Millisecond*100, cancel)
+	err = client.Call(ctx, "Sleep", "Cancel", 1, &reply)
+	_assert(err != nil && strings.Contains(err.Error(), context.Canceled.Error()), "expect a canceled error, got %v", err)
+	select {
+	case err = <-sleepCanceled:
+		_assert(err == context.Canceled, "expect canceled, got %v", err)
+	case <-time.After(time.Second):
+		t.Fatal("handler context is not canceled")
+	}
+
+	err = client.Call(context.Background(), "Sleep", "Honor", time.Duration(0), &reply)
+	_assert(err == nil && reply == 1, "expect 1, got %d, err %v", reply, err)
+}
+
+/*
+测试截止时间。
+ctx 的截止时间随请求传给服务端；Server.MaxHandleTimeout 限制处理时间；到达时已经过期的请求直接回复错误
+*/
+func TestServer_Deadline(t *testing.T) {
+	t.Parallel()
+	addr := startSleepServerWith(t, &Server{MaxHandleTimeout: time.Millisecond * 100})
+	client, err := Dial("tcp", addr)
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+
+	t.Run("propagate", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+		defer cancel()
+		deadline, _ := ctx.Deadline()
+		var reply int64
+		err := client.Call(ctx, "Sleep", "Deadline", 0, &reply)
+		// 服务端以收到请求的时间重建截止时间，只会因为传输稍晚于客户端的截止时间
+		skew := time.Duration(reply - deadline.UnixNano())
+		_assert(err == nil && skew >= 0 && skew < time.Millisecond*20, "expect deadline %d, got %d, err %v", deadline.UnixNano(), reply, err)
+	})
+	t.Run("max handle timeout", func(t *testing.T) {
+		var reply int
+		err := client.Call(context.Background(), "Sleep", "Honor", time.Second, &reply)
+		_assert(err != nil && strings.Contains(err.Error(), "handle timeout"), "expect a timeout error, got %v", err)
+	})
+	t.Run("expired", func(t *testing.T) {
+		cc := dialCodec(t, addr, &Option{})
+		h := codec.Header{Service: "Sleep", Method: "Honor", Seq: 1, Timeout: -1}
+		_assert(cc.Write(&h, time.Duration(0)) == nil, "failed to write request")
+		_assert(cc.ReadHeader(&h) == nil && strings.Contains(h.Error, "deadline exceeded"), "expect a deadline error, got %+v", h)
+	})
+}
+
+/*
+测试优雅关闭。
+Shutdown 等待已接收的请求处理完成，客户端收到 GoAway 后不可用；ctx 结束时强制关闭连接
+*/
+func TestServer_Shutdown(t *testing.T) {
+	t.Parallel()
+
+	t.Run("drain", func(t *testing.T) {
+		server := NewServer()
+		addr := startSleepServerWith(t, server)
+		client, err := Dial("tcp", addr)
+		_assert(err == nil, "failed to dial: %v", err)
+		defer func() { _ = client.Close() }()
+
+		var reply int
+		call := client.Go("Sleep", "Ignore", time.Millisecond*200, &reply, nil)
+		time.Sleep(time.Millisecond * 50)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_assert(server.Shutdown(ctx) == nil, "expect shutdown to drain in time")
+		call = <-call.Done
+		_assert(call.Error == nil && reply == 1, "expect in-flight call to finish, got %d, err %v", reply, call.Error)
+		_assert(!client.IsAvailable(), "client should be unavailable after GoAway")
+		_, err = Dial("tcp", addr)
+		_assert(err != nil, "expect dial error after shutdown")
+	})
+	t.Run("force", func(t *testing.T) {
+		server := NewServer()
+		addr := startSleepServerWith(t, server)
+		client, err := Dial("tcp", addr)
+		_assert(err == nil, "failed to dial: %v", err)
+		defer func() { _ = client.Close() }()
+
+		var reply int
+		call := client.Go("Sleep", "Honor", time.Second*5, &reply, nil)
+		time.Sleep(time.Millisecond * 50)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+		defer cancel()
+		_assert(server.Shutdown(ctx) == context.DeadlineExceeded, "expect shutdown to time out")
+		call = <-call.Done
+		_assert(call.Error != nil, "expect in-flight call to fail")
+	})
+	t.Run("close", func(t *testing.T) {
+		server := NewServer()
+		addr := startSleepServerWith(t, server)
+		client, err := Dial("tcp", addr)
+		_assert(err == nil, "failed to dial: %v", err)
+		defer func() { _ = client.Close() }()
+
+		_assert(server.Close() == nil, "failed to close server")
+		var reply int
+		err = client.Call(context.Background(), "Sleep", "Honor", time.Duration(0), &reply)
+		_assert(err != nil, "expect call error after close")
+	})
+}
+
+/*
+测试服务端拦截器。
+按注册顺序执行，能读取调用信息、修改 reply，以及短路返回错误
+*/
+func TestServer_Use(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	var order []string
+	server.Use(func(ctx context.Context, info *ServerInfo, args, reply interface{}, next Handler) error {
+		order = append(order, "outer")
+		if info.Metadata.Get("token") != "secret" {
+			return errors.New("unauthenticated")
+		}
+		return next(ctx, args, reply)
+	}, func(ctx context.Context, info *ServerInfo, args, reply interface{}, next Handler) error {
+		order = append(order, "inner "+info.Service+"."+info.Method)
+		err := next(ctx, args, reply)
+		*reply.(*int) += 10
+		return err
+	})
+	addr := startSleepServerWith(t, server)
+	client, err := Dial("tcp", addr)
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+
+	var reply int
+	err = client.Call(context.Background(), "Sleep", "Honor", time.Duration(0), &reply)
+	_assert(err != nil && strings.Contains(err.Error(), "unauthenticated"), "expect short-circuit error, got %v", err)
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "token", "secret")
+	err = client.Call(ctx, "Sleep", "Honor", time.Duration(0), &reply)
+	_assert(err == nil && reply == 11, "expect 11, got %d, err %v", reply, err)
+	_assert(reflect.DeepEqual(order, []string{"outer", "outer", "inner Sleep.Honor"}), "wrong interceptor order: %v", order)
+}
+
+/*
+测试方法 panic。
+只有这一次调用失败，服务端继续运行；Debug 为 true 时错误中包含调用栈；
+拦截器 panic 时同样回复 Internal，并计入方法的 NumPanic
+*/
+func TestServer_Panic(t *testing.T) {
+	t.Parallel()
+	for _, debug := range []bool{false, true} {
+		addr := startSleepServerWith(t, &Server{Debug: debug})
+		client, err := Dial("tcp", addr)
+		_assert(err == nil, "failed to dial: %v", err)
+
+		var reply int
+		err = client.Call(context.Background(), "Sleep", "Panic", 0, &reply)
+		_assert(err != nil && strings.Contains(err.Error(), "Sleep.Panic panic: boom"), "expect a panic error, got %v", err)
+		_assert(strings.Contains(err.Error(), "goroutine") == debug, "stack in error should be %v, got %v", debug, err)
+		err = client.Call(context.Background(), "Sleep", "Honor", time.Duration(0), &reply)
+		_assert(err == nil && reply == 1, "expect 1, got %d, err %v", reply, err)
+		_ = client.Close()
+	}
+
+	server := NewServer()
+	server.Use(func(ctx context.Context, info *ServerInfo, args, reply interface{}, next Handler) error {
+		if info.Method == "Deny" {
+			panic("interceptor boom")
+		}
+		return next(ctx, args, reply)
+	})
+	client, err := Dial("tcp", startSleepServerWith(t, server))
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+	var reply int
+	err = client.Call(context.Background(), "Sleep", "Deny", "guest", &reply)
+	_assert(status.Code(err) == codes.Internal && strings.Contains(err.Error(), "Sleep.Deny panic: interceptor boom"), "expect an interceptor panic error, got %v", err)
+	err = client.Call(context.Background(), "Sleep", "Honor", time.Duration(0), &reply)
+	_assert(err == nil && reply == 1, "expect 1, got %d, err %v", reply, err)
+	svc, _ := server.ServiceMap.Load("Sleep")
+	n := svc.(*service.Service).Method["Deny"].NumPanics()
+	_assert(n == 1, "expect 1 panic counted for Sleep.Deny, got %d", n)
+}
+
+/*
+测试错误码。
+服务端的错误映射为稳定的错误码，方法返回的 Status 连同附加信息传回客户端
+*/
+func TestServer_Status(t *testing.T) {
+	t.Parallel()
+	addr := startSleepServerWith(t, &Server{MaxHandleTimeout: time.Millisecond * 50})
+	client, err := Dial("tcp", addr)
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+
+	var reply int
+	cases := []struct {
+		service, method string
+		args            interface{}
+		code            codes.Code
+	}{
+		{"Sleep", "Honor", time.Duration(0), codes.OK},
+		{"Nope", "Honor", time.Duration(0), codes.NotFound},
+		{"Sleep", "Nope", time.Duration(0), codes.NotFound},
+		{"Sleep", "Honor", time.Second, codes.DeadlineExceeded},
+		{"Sleep", "Panic", 0, codes.Internal},
+		{"Sleep", "Deny", "bob", codes.PermissionDenied},
+	}
+	for _, c := range cases {
+		err = client.Call(context.Background(), c.service, c.method, c.args, &reply)
+		_assert(status.Code(err) == c.code, "%s.%s: expect %s, got %v", c.service, c.method, c.code, err)
+	}
+	s := status.Convert(err)
+	_assert(s.Message() == "denied bob" && reflect.DeepEqual(s.Details(), []string{"role=guest"}), "wrong status: %v", err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = client.Call(ctx, "Sleep", "Honor", time.Duration(0), &reply)
+	_assert(status.Code(err) == codes.Canceled, "expect Canceled, got %v", err)
+}
+
+/*
+测试服务端的限制。
+超出 MaxBodySize 的请求收到 ResourceExhausted，分帧的连接继续可用；压缩连接上解压后超出限制的消息使连接被关闭；
+超出 MaxInflight 的请求被拒绝；
+不握手的连接在 HandshakeTimeout 后被关闭；空闲的连接在 IdleTimeout 后被关闭；各项都计入 Metrics
+*/
+func TestServer_Limits(t *testing.T) {
+	t.Parallel()
+	server := &Server{MaxHeaderSize: 1 << 10, MaxBodySize: 64, HandshakeTimeout: time.Millisecond * 100, IdleTimeout: time.Millisecond * 200, MaxInflight: 1}
+	addr := startSleepServerWith(t, server)
+
+	client, err := Dial("tcp", addr, &Option{Framing: true})
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+	var reply int
+	err = client.Call(context.Background(), "Sleep", "Deny", strings.Repeat("x", 128), &reply)
+	_assert(status.Code(err) == codes.ResourceExhausted, "expect ResourceExhausted, got %v", err)
+
+	compressed, err := Dial("tcp", addr, &Option{Framing: true, Compress: codec.CompressGzip})
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = compressed.Close() }()
+	err = compressed.Call(context.Background(), "Sleep", "Deny", strings.Repeat("x", 64<<10), &reply)
+	_assert(err != nil && !compressed.IsAvailable(), "expect the server to close a connection sending a compression bomb, got %v", err)
+
+	done := make(chan error, 1)
+	go func() { done <- client.Call(context.Background(), "Sleep", "Honor", time.Millisecond*300, new(int)) }()
+	time.Sleep(time.Millisecond * 50)
+	err = client.Call(context.Background(), "Sleep", "Honor", time.Duration(0), &reply)
+	_assert(status.Code(err) == codes.ResourceExhausted, "expect ResourceExhausted over MaxInflight, got %v", err)
+	_assert(<-done == nil, "the in-flight call should succeed")
+
+	conn, err := net.Dial("tcp", addr)
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	_assert(err != nil && !errors.Is(err, os.ErrDeadlineExceeded), "expect the server to close a silent connection, got %v", err)
+
+	time.Sleep(time.Millisecond * 400)
+	_assert(!client.IsAvailable(), "expect the idle connection to be closed")
+	m := server.Metrics()
+	_assert(m == Metrics{BodyTooLarge: 1, FrameTooLarge: 1, HandshakeTimeouts: 1, IdleTimeouts: 1, InflightRejected: 1}, "metrics mismatch: %+v", m)
+}
+
+/*
+测试单个连接上的协程数有上限。
+只设置 MaxConnConcurrency、ConnQueueSize 时，大量请求使连接暂停读取，而不是为每个请求启动协程。
+不调用 t.Parallel()，协程数量不受其他测试干扰
+*/
+func TestServer_ConnConcurrencyBound(t *testing.T) {
+	gate := newGate()
+	server := &Server{MaxConnConcurrency: 1, ConnQueueSize: 1}
+	_ = server.Register(gate)
+	client, err := Dial("tcp", startSleepServerWith(t, server))
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+
+	base := runtime.NumGoroutine()
+	calls := make([]*Call, 100)
+	for i := range calls {
+		calls[i] = client.Go("Gate", "Wait", i, new(int), nil)
+	}
+	<-gate.entered
+	waitUntil(t, "the connection to pause", func() bool { return server.Metrics().ConnPaused == 1 })
+	_assert(inflightRequests(server) == 2, "expect 2 requests on a paused connection, got %d", inflightRequests(server))
+	_assert(runtime.NumGoroutine()-base < 10, "expect a bounded number of goroutines, got %d more", runtime.NumGoroutine()-base)
+
+	go func() {
+		gate.release <- struct{}{}
+		for range calls[1:] {
+			<-gate.entered
+			gate.release <- struct{}{}
+		}
+	}()
+	for _, call := range calls {
+		<-call.Done
+		_assert(call.Error == nil, "call failed: %v", call.Error)
+	}
+}
+
+/*
+Gate
+Wait 在 entered 上报告开始执行，阻塞直到从 release 收到一个值，或者 ctx 被取消（在 canceled 上报告）
+*/
+type Gate struct {
+	entered  chan int
+	release  chan struct{}
+	canceled chan int
+}
+
+func newGate() *Gate {
+	return &Gate{entered: make(chan int, 8), release: make(chan struct{}), canceled: make(chan int, 8)}
+}
+
+func (g *Gate) Wait(ctx context.Context, n int, reply *int) error {
+	g.entered <- n
+	select {
+	case <-g.release:
+		*reply = n
+		return nil
+	case <-ctx.Done():
+		g.canceled <- n
+		return ctx.Err()
+	}
+}
+
+// waitUntil 轮询直到 cond 成立，超过 2s 时测试失败
+func waitUntil(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(time.Second * 2)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// inflightRequests 服务端所有连接上正在处理的请求数，包括等待并发额度的请求
+func inflightRequests(server *Server) (n int) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	for c := range server.conns {
+		c.mu.Lock()
+		n += c.active
+		c.mu.Unlock()
+	}
+	return n
+}
+
+/*
+测试并发限制。
+达到 MaxConcurrency 时请求排队，队列已满时回复 ResourceExhausted，排队期间超时的请求不计入 Queued；
+达到 MaxConnConcurrency 时后到的请求与流等前面的方法返回后才执行，等待期间连接仍然读取取消消息；
+等待的请求达到 ConnQueueSize 时连接暂停读取
+*/
+func TestServer_Concurrency(t *testing.T) {
+	t.Parallel()
+	gate := newGate()
+	server := &Server{MaxConcurrency: 1, QueueSize: 1}
+	_ = server.Register(gate)
+	addr := startSleepServerWith(t, server)
+	dial := func() *Client {
+		client, err := Dial("tcp", addr)
+		_assert(err == nil, "failed to dial: %v", err)
+		t.Cleanup(func() { _ = client.Close() })
+		return client
+	}
+	queued := func(n int) func() bool {
+		return func() bool { return len(server.concurrency().waiting) == n }
+	}
+	done := make(chan error, 2)
+	go func() { done <- dial().Call(context.Background(), "Gate", "Wait", 1, new(int)) }()
+	_assert(<-gate.entered == 1, "expect the first call to run")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	err := dial().Call(ctx, "Gate", "Wait", 2, new(int))
+	_assert(err != nil, "expect the queued call to time out")
+	waitUntil(t, "the expired call to leave the queue", queued(0))
+	_assert(server.Metrics().Queued == 0, "expired calls should not be counted as queued, got %+v", server.Metrics())
+
+	go func() { done <- dial().Call(context.Background(), "Gate", "Wait", 3, new(int)) }()
+	waitUntil(t, "a queued call", queued(1))
+	err = dial().Call(context.Background(), "Gate", "Wait", 4, new(int))
+	_assert(status.Code(err) == codes.ResourceExhausted, "expect ResourceExhausted with a full queue, got %v", err)
+	gate.release <- struct{}{}
+	_assert(<-gate.entered == 3, "expect the queued call to run after the first one returns")
+	gate.release <- struct{}{}
+	_assert(<-done == nil && <-done == nil, "the running and queued calls should succeed")
+	m := server.Metrics()
+	_assert(m.ConcurrencyRejected == 1 && m.Queued == 1 && m.QueueWait > 0, "metrics mismatch: %+v", m)
+
+	// MaxConnConcurrency 同样限制流
+	gate = newGate()
+	server = &Server{MaxConnConcurrency: 1, ConnQueueSize: 2}
+	_ = server.Register(gate)
+	_ = server.Register(new(Report))
+	client, err := Dial("tcp", startSleepServerWith(t, server))
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+	first := client.Go("Gate", "Wait", 1, new(int), nil)
+	_assert(<-gate.entered == 1, "expect the first call to run")
+	second := client.Go("Gate", "Wait", 2, new(int), nil)
+	stream, err := client.NewStream(context.Background(), "Report", "Rows", 3, new(Row))
+	_assert(err == nil, "failed to open stream: %v", err)
+	waitUntil(t, "the call and the stream to wait", func() bool { return server.Metrics().ConnQueued == 2 })
+	// 等待的请求已满，连接暂停读取，第四个请求不会被处理
+	fourth := client.Go("Gate", "Wait", 4, new(int), nil)
+	waitUntil(t, "the connection to pause", func() bool { return server.Metrics().ConnPaused == 1 })
+	_assert(inflightRequests(server) == 3, "expect 3 requests on a paused connection, got %d", inflightRequests(server))
+	select {
+	case n := <-gate.entered:
+		t.Fatalf("call %d runs while the connection is at its limit", n)
+	default:
+	}
+	gate.release <- struct{}{}
+	<-first.Done
+	_assert(first.Error == nil, "call failed: %v", first.Error)
+	go func() {
+		for i := 0; i < 2; i++ {
+			<-gate.entered
+			gate.release <- struct{}{}
+		}
+	}()
+	for i := 0; i < 3; i++ {
+		v, err := stream.Recv()
+		_assert(err == nil && v.(*Row).I == i, "expect row %d, got %v, err %v", i, v, err)
+	}
+	for _, call := range []*Call{second, fourth} {
+		<-call.Done
+		_assert(call.Error == nil, "call failed: %v", call.Error)
+	}
+	_assert(server.Metrics().ConnQueueWait > 0, "expect the queue wait to be recorded, got %+v", server.Metrics())
+
+	// 等待额度的请求可以被取消，客户端断开后所有方法都会结束
+	gate = newGate()
+	server = &Server{MaxConnConcurrency: 1, ConnQueueSize: 1}
+	_ = server.Register(gate)
+	client, err = Dial("tcp", startSleepServerWith(t, server))
+	_assert(err == nil, "failed to dial: %v", err)
+	go func() { _ = client.Call(context.Background(), "Gate", "Wait", 1, new(int)) }()
+	_assert(<-gate.entered == 1, "expect the first call to run")
+	ctx, cancel = context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- client.Call(ctx, "Gate", "Wait", 2, new(int)) }()
+	waitUntil(t, "the second call to wait", func() bool { return server.Metrics().ConnQueued == 1 })
+	cancel()
+	err = <-errc
+	_assert(err != nil && strings.Contains(err.Error(), context.Canceled.Error()), "expect a canceled error, got %v", err)
+	waitUntil(t, "the canceled call to leave the queue", func() bool { return inflightRequests(server) == 1 })
+	_ = client.Close()
+	select {
+	case n := <-gate.canceled:
+		_assert(n == 1, "expect the running call to be canceled, got %d", n)
+	case <-time.After(time.Second * 2):
+		t.Fatal("handler context is not canceled after the client closed")
+	}
+	waitUntil(t, "all handlers to return", func() bool { return inflightRequests(server) == 0 })
+	_assert(len(gate.entered) == 0, "the canceled call should never run")
+}
@@ -1,24 +1,62 @@
 package service
 
 import (
+	"context"
+	"fmt"
 	"go/ast"
 	"log"
 	"reflect"
+	"runtime/debug"
 	"sync/atomic"
 )
 
 type MethodType struct {
-	Method    reflect.Method // 方法本身
-	ArgType   reflect.Type   // 入参类型
-	ReplyType reflect.Type   // 返回类型
-	NumCall   uint64         // 统计方法调用次数
+	Method       reflect.Method // 方法本身
+	ArgType      reflect.Type   // 入参类型，客户端流式方法为 <-chan T
+	ReplyType    reflect.Type   // 返回类型，服务端流式方法为 chan<- T
+	HasContext   bool           // 第一个入参是否为 context.Context
+	ServerStream bool           // 最后一个入参为 chan<- T，方法通过它向客户端发送多个结果
+	ClientStream bool           // 倒数第二个入参为 <-chan T，方法通过它接收客户端发送的多个参数
+	NumCall      uint64         // 统计方法调用次数
+	NumPanic     uint64         // 统计方法 panic 次数
 }
 
+var (
+	typeOfError   = reflect.TypeOf((*error)(nil)).Elem()
+	typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
+)
+
 func (m *MethodType) NumCalls() uint64 {
 	return atomic.LoadUint64(&m.NumCall)
 }
 
+func (m *MethodType) NumPanics() uint64 {
+	return atomic.LoadUint64(&m.NumPanic)
+}
+
+/*
+PanicError
+方法（或者服务端的拦截器）执行时发生 panic，恢复后返回，Stack 为 panic 时的调用栈，见 RecordPanic
+*/
+type PanicError struct {
+	Service string
+	Method  string
+	Value   interface{} // recover() 的返回值
+	Stack   []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("rpc server: %s.%s panic: %v", e.Service, e.Method, e.Value)
+}
+
+/*
+NewArgv
+客户端流式方法返回无缓冲的双向 channel，调用方向其中发送客户端的参数
+*/
 func (m *MethodType) NewArgv() reflect.Value {
+	if m.ClientStream {
+		return reflect.MakeChan(reflect.ChanOf(reflect.BothDir, m.ArgType.Elem()), 0)
+	}
 	var argv reflect.Value
 
 	// 指针类型和值类型创建实例的方式有细微区别
@@ -32,7 +70,14 @@ func (m *MethodType) NewArgv() reflect.Value {
 	return argv
 }
 
+/*
+NewReplyv
+服务端流式方法返回无缓冲的双向 channel，调用方从中接收方法发送的结果
+*/
 func (m *MethodType) NewReplyv() reflect.Value {
+	if m.ServerStream {
+		return reflect.MakeChan(reflect.ChanOf(reflect.BothDir, m.ReplyType.Elem()), 0)
+	}
 	// reply must be a pointer type
 	replyv := reflect.New(m.ReplyType.Elem())
 	switch m.ReplyType.Elem().Kind() {
@@ -74,8 +119,15 @@ func NewService(rcvr interface{}) *Service {
 RegisterMethods
 
 过滤出了符合条件的方法：
-1. 两个导出或内置类型的入参
-2. 返回值有且只有 1 个，类型为 error
+ 1. 两个导出或内置类型的入参，或者 context.Context 加上两个导出或内置类型的入参
+    func (t *T) MethodName(argType T1, replyType *T2) error
+    func (t *T) MethodName(ctx context.Context, argType T1, replyType *T2) error
+ 2. 返回值有且只有 1 个，类型为 error
+ 3. 服务端流式方法的最后一个入参为只发送的 channel，方法返回即为流结束，返回后不能再发送
+    func (t *T) MethodName(ctx context.Context, argType T1, stream chan<- T2) error
+ 4. 客户端流式方法的参数为只接收的 channel，客户端结束发送或者取消时被关闭；两者同时使用即为双向流
+    func (t *T) MethodName(ctx context.Context, stream <-chan T1, replyType *T2) error
+    func (t *T) MethodName(ctx context.Context, in <-chan T1, out chan<- T2) error
 */
 func (s *Service) RegisterMethods() {
 	s.Method = make(map[string]*MethodType)
@@ -84,23 +136,39 @@ func (s *Service) RegisterMethods() {
 		method := s.Typ.Method(i)
 		mType := method.Type
 
-		if mType.NumIn() != 3 || mType.NumOut() != 1 {
+		if mType.NumOut() != 1 || mType.Out(0) != typeOfError {
 			continue
 		}
-		if mType.Out(0) != reflect.TypeOf((*error)(nil)).Elem() {
+
+		var hasContext bool
+		switch {
+		case mType.NumIn() == 3:
+		case mType.NumIn() == 4 && mType.In(1) == typeOfContext:
+			hasContext = true
+		default:
 			continue
 		}
+		argType, replyType := mType.In(mType.NumIn()-2), mType.In(mType.NumIn()-1)
 
-		argType, replyType := mType.In(1), mType.In(2)
-
+		serverStream := replyType.Kind() == reflect.Chan && replyType.ChanDir() == reflect.SendDir
+		if serverStream && !isExportedOrBuiltinType(replyType.Elem()) {
+			continue
+		}
+		clientStream := argType.Kind() == reflect.Chan && argType.ChanDir() == reflect.RecvDir
+		if clientStream && !isExportedOrBuiltinType(argType.Elem()) {
+			continue
+		}
 		if !isExportedOrBuiltinType(argType) || !isExportedOrBuiltinType(replyType) {
 			continue
 		}
 
 		s.Method[method.Name] = &MethodType{
-			Method:    method,
-			ArgType:   argType,
-			ReplyType: replyType,
+			Method:       method,
+			ArgType:      argType,
+			ReplyType:    replyType,
+			HasContext:   hasContext,
+			ServerStream: serverStream,
+			ClientStream: clientStream,
 		}
 		log.Printf("rpc server: register %s.%s\n", s.Name, method.Name)
 	}
@@ -111,9 +179,39 @@ func isExportedOrBuiltinType(t reflect.Type) bool {
 }
 
 func (s *Service) Call(m *MethodType, argv, replyv reflect.Value) error {
+	return s.CallContext(context.Background(), m, argv, replyv)
+}
+
+/*
+CallContext
+方法的第一个入参为 context.Context 时传入 ctx，否则忽略 ctx；
+方法 panic 时恢复，记录调用栈并返回 *PanicError，不会影响其他调用
+*/
+/*
+RecordPanic
+记录方法 m 的一次 panic：计入 NumPanic，打印调用栈，返回对应的 *PanicError；
+需要在 recover 的 defer 中调用，调用栈才包含 panic 的位置
+*/
+func (s *Service) RecordPanic(m *MethodType, v interface{}) *PanicError {
+	atomic.AddUint64(&m.NumPanic, 1)
+	perr := &PanicError{Service: s.Name, Method: m.Method.Name, Value: v, Stack: debug.Stack()}
+	log.Printf("%v\n%s", perr, perr.Stack)
+	return perr
+}
+
+func (s *Service) CallContext(ctx context.Context, m *MethodType, argv, replyv reflect.Value) (err error) {
 	atomic.AddUint64(&m.NumCall, 1)
+	defer func() {
+		if r := recover(); r != nil {
+			err = s.RecordPanic(m, r)
+		}
+	}()
 	f := m.Method.Func
-	returnValues := f.Call([]reflect.Value{s.Rcvr, argv, replyv})
+	in := []reflect.Value{s.Rcvr, argv, replyv}
+	if m.HasContext {
+		in = []reflect.Value{s.Rcvr, reflect.ValueOf(&ctx).Elem(), argv, replyv}
+	}
+	returnValues := f.Call(in)
 	if errInter := returnValues[0].Interface(); errInter != nil {
 		return errInter.(error)
 	}
@@ -1,6 +1,8 @@
 package service
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"reflect"
 	"testing"
@@ -25,6 +27,24 @@ func (f Foo) sum(args Args, reply *int) error {
 	return nil
 }
 
+type Baz int
+
+type ctxKey struct{}
+
+func (b Baz) Sum(ctx context.Context, args Args, reply *int) error {
+	*reply = args.Num1 + args.Num2 + ctx.Value(ctxKey{}).(int)
+	return nil
+}
+
+// 第一个参数不是 context.Context
+func (b Baz) Sum3(n int, args Args, reply *int) error {
+	return nil
+}
+
+func (b Baz) Panic(ctx context.Context, args Args, reply *int) error {
+	panic("boom")
+}
+
 func _assert(condition bool, msg string, v ...interface{}) {
 	if !condition {
 		panic(fmt.Sprintf("assertion failed: "+msg, v...))
@@ -51,3 +71,31 @@ func TestMethodType_Call(t *testing.T) {
 	_assert(err == nil && *replyv.Interface().(*int) == 4 && mType.NumCalls() == 1, "failed to call Foo.Sum")
 }
 
+
+func TestMethodType_CallContext(t *testing.T) {
+	var baz Baz
+	s := NewService(&baz)
+	_assert(len(s.Method) == 2, "wrong service Method, expect 2, but got %d", len(s.Method))
+	mType := s.Method["Sum"]
+	_assert(mType != nil && mType.HasContext, "wrong Method, Sum should has context")
+
+	argv := mType.NewArgv()
+	replyv := mType.NewReplyv()
+	argv.Set(reflect.ValueOf(Args{Num1: 1, Num2: 3}))
+	ctx := context.WithValue(context.Background(), ctxKey{}, 10)
+	err := s.CallContext(ctx, mType, argv, replyv)
+	_assert(err == nil && *replyv.Interface().(*int) == 14, "failed to call Baz.Sum")
+}
+
+func TestMethodType_CallPanic(t *testing.T) {
+	var baz Baz
+	s := NewService(&baz)
+	mType := s.Method["Panic"]
+
+	argv := mType.NewArgv()
+	replyv := mType.NewReplyv()
+	err := s.CallContext(context.Background(), mType, argv, replyv)
+	var perr *PanicError
+	_assert(errors.As(err, &perr) && perr.Value == "boom" && len(perr.Stack) > 0, "expect a PanicError, got %v", err)
+	_assert(mType.NumCalls() == 1 && mType.NumPanics() == 1, "wrong statistics: %d calls, %d panics", mType.NumCalls(), mType.NumPanics())
+}
@@ -0,0 +1,199 @@
+package myGoRPC
+
+import (
+	"context"
+	"myGoRPC/codec"
+	"myGoRPC/codes"
+	"myGoRPC/status"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrServerClosed Shutdown、Close 之后到达的请求收到的错误
+var ErrServerClosed = status.Error(codes.Unavailable, "rpc server: server closed")
+
+/*
+serverConn
+一个连接的状态，Shutdown 通过它通知客户端，并等待已接收的请求处理完成
+*/
+type serverConn struct {
+	cc       codec.Codec
+	sending  *sync.Mutex    // 与 serveCodec 共用，保证回复逐个发送
+	wg       sync.WaitGroup // 正在处理的请求
+	slots    chan struct{}  // 正在执行的方法，见 Server.MaxConnConcurrency，没有限制时为 nil
+	admitted chan struct{}  // 正在执行与等待额度的请求，见 admit
+	quit     chan struct{}  // close 时关闭，结束暂停的读循环
+	once     sync.Once
+	mu       sync.Mutex // 保护以下，以及 draining 之前的 wg.Add
+	draining bool
+	active   int         // 正在处理的请求数，见 Server.MaxInflight
+	idle     *time.Timer // 见 watchIdle，没有设置 Server.IdleTimeout 时为 nil
+	timeout  time.Duration
+}
+
+func newServerConn(cc codec.Codec, concurrency, queue int) *serverConn {
+	c := &serverConn{cc: cc, sending: new(sync.Mutex), quit: make(chan struct{})}
+	if concurrency > 0 {
+		c.slots = make(chan struct{}, concurrency)
+		c.admitted = make(chan struct{}, concurrency+max(queue, 0))
+	}
+	return c
+}
+
+// close 关闭连接，读循环随之结束并取消所有请求的 context，等待并发额度的请求也随之结束
+func (c *serverConn) close() error {
+	c.once.Do(func() { close(c.quit) })
+	return c.cc.Close()
+}
+
+/*
+add
+记录一个新的请求；连接正在关闭时返回 ErrServerClosed，
+已有 max 个（大于 0 时）正在处理的请求时返回 errTooManyInflight
+*/
+func (c *serverConn) add(max int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.draining {
+		return ErrServerClosed
+	}
+	if max > 0 && c.active >= max {
+		return errTooManyInflight
+	}
+	c.active++
+	c.wg.Add(1)
+	return nil
+}
+
+// done 一个请求处理完成，最后一个请求完成时重新开始计算空闲时间
+func (c *serverConn) done() {
+	c.mu.Lock()
+	c.active--
+	if c.active == 0 && c.idle != nil {
+		c.idle.Reset(c.timeout)
+	}
+	c.mu.Unlock()
+	c.wg.Done()
+}
+
+/*
+goAway
+之后不再接收新的请求，并通知客户端（codec.KindGoAway）；
+draining 之后不会再有 wg.Add，调用方可以安全地 wg.Wait
+*/
+func (c *serverConn) goAway(server *Server) {
+	c.mu.Lock()
+	if c.draining {
+		c.mu.Unlock()
+		return
+	}
+	c.draining = true
+	c.mu.Unlock()
+	server.sendResponse(c.cc, &codec.Header{Kind: codec.KindGoAway}, invalidRequest, c.sending)
+}
+
+func (server *Server) shuttingDown() bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.inShutdown
+}
+
+// trackListener add 为 true 时记录 l，Shutdown 开始后返回 false
+func (server *Server) trackListener(l net.Listener, add bool) bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if !add {
+		delete(server.listeners, l)
+		return true
+	}
+	if server.inShutdown {
+		return false
+	}
+	if server.listeners == nil {
+		server.listeners = make(map[net.Listener]struct{})
+	}
+	server.listeners[l] = struct{}{}
+	return true
+}
+
+// trackConn add 为 true 时记录 c，Shutdown 开始后返回 false
+func (server *Server) trackConn(c *serverConn, add bool) bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if !add {
+		delete(server.conns, c)
+		return true
+	}
+	if server.inShutdown {
+		return false
+	}
+	if server.conns == nil {
+		server.conns = make(map[*serverConn]struct{})
+	}
+	server.conns[c] = struct{}{}
+	return true
+}
+
+// closeListeners 标记 Shutdown 开始，关闭所有 listener，返回当前的连接
+func (server *Server) closeListeners() (conns []*serverConn, err error) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.inShutdown = true
+	for l := range server.listeners {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(server.listeners, l)
+	}
+	for c := range server.conns {
+		conns = append(conns, c)
+	}
+	return conns, err
+}
+
+/*
+Shutdown
+优雅关闭：
+1. 关闭所有 listener，不再接受新的连接
+2. 向每个连接发送 codec.KindGoAway，客户端不再发送新的请求，之后到达的请求回复 ErrServerClosed
+3. 等待已接收的请求处理完成、回复发出后关闭连接
+
+ctx 结束时强制关闭所有连接（正在执行的方法的 context 随之取消），返回 ctx.Err()
+*/
+func (server *Server) Shutdown(ctx context.Context) error {
+	conns, err := server.closeListeners()
+	for _, c := range conns {
+		c.goAway(server)
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		for _, c := range conns {
+			c.wg.Wait()
+		}
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	for _, c := range conns {
+		_ = c.close()
+	}
+	return err
+}
+
+/*
+Close
+立即关闭所有 listener 与连接，不等待正在处理的请求
+*/
+func (server *Server) Close() error {
+	conns, err := server.closeListeners()
+	for _, c := range conns {
+		_ = c.close()
+	}
+	return err
+}
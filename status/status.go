@@ -0,0 +1,124 @@
+package status
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"myGoRPC/codes"
+)
+
+/*
+Status
+调用结果：错误码、错误信息以及可选的附加信息（Details），
+服务端通过 codec.Header 的 Code、Error、Details 发送，客户端据此还原
+*/
+type Status struct {
+	code    codes.Code
+	message string
+	details []string
+}
+
+func New(c codes.Code, msg string) *Status {
+	return &Status{code: c, message: msg}
+}
+
+func Newf(c codes.Code, format string, a ...interface{}) *Status {
+	return New(c, fmt.Sprintf(format, a...))
+}
+
+// Error 相当于 New(c, msg).Err()
+func Error(c codes.Code, msg string) error {
+	return New(c, msg).Err()
+}
+
+func Errorf(c codes.Code, format string, a ...interface{}) error {
+	return Newf(c, format, a...).Err()
+}
+
+func (s *Status) Code() codes.Code {
+	if s == nil {
+		return codes.OK
+	}
+	return s.code
+}
+
+func (s *Status) Message() string {
+	if s == nil {
+		return ""
+	}
+	return s.message
+}
+
+func (s *Status) Details() []string {
+	if s == nil {
+		return nil
+	}
+	return s.details
+}
+
+// WithDetails 返回追加了 details 的副本
+func (s *Status) WithDetails(details ...string) *Status {
+	c := *s
+	c.details = append(append([]string(nil), s.details...), details...)
+	return &c
+}
+
+// Err 转换为 error，codes.OK 时返回 nil
+func (s *Status) Err() error {
+	if s.Code() == codes.OK {
+		return nil
+	}
+	return &statusError{s: s}
+}
+
+type statusError struct {
+	s *Status
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("rpc error: code = %s desc = %s", e.s.code, e.s.message)
+}
+
+/*
+FromError
+err 由 Status.Err 得到（包括被 fmt.Errorf("%w") 包装）时返回对应的 Status 与 true；
+err 为 nil 时返回 nil 与 true；其他 error 返回 codes.Unknown 与 false
+*/
+func FromError(err error) (*Status, bool) {
+	if err == nil {
+		return nil, true
+	}
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.s, true
+	}
+	return New(codes.Unknown, err.Error()), false
+}
+
+// Convert 与 FromError 相同，只返回 Status
+func Convert(err error) *Status {
+	s, _ := FromError(err)
+	return s
+}
+
+// Code 得到 err 的错误码，err 为 nil 时返回 codes.OK
+func Code(err error) codes.Code {
+	return Convert(err).Code()
+}
+
+/*
+FromContextError
+context.DeadlineExceeded 对应 codes.DeadlineExceeded，context.Canceled 对应 codes.Canceled，其他为 codes.Unknown
+*/
+func FromContextError(err error) *Status {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, context.DeadlineExceeded):
+		return New(codes.DeadlineExceeded, err.Error())
+	case errors.Is(err, context.Canceled):
+		return New(codes.Canceled, err.Error())
+	default:
+		return New(codes.Unknown, err.Error())
+	}
+}
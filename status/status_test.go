@@ -0,0 +1,32 @@
+package status
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"myGoRPC/codes"
+	"reflect"
+	"testing"
+)
+
+func _assert(condition bool, msg string, v ...interface{}) {
+	if !condition {
+		panic(fmt.Sprintf("assertion failed: "+msg, v...))
+	}
+}
+
+func TestStatus(t *testing.T) {
+	s := New(codes.NotFound, "no such thing").WithDetails("a", "b")
+	err := fmt.Errorf("wrapped: %w", s.Err())
+	got, ok := FromError(err)
+	_assert(ok && got.Code() == codes.NotFound && got.Message() == "no such thing", "wrong status: %v", got)
+	_assert(reflect.DeepEqual(got.Details(), []string{"a", "b"}), "wrong details: %v", got.Details())
+	_assert(err.Error() == "wrapped: rpc error: code = NotFound desc = no such thing", "wrong message: %s", err)
+
+	_assert(New(codes.OK, "").Err() == nil && Code(nil) == codes.OK, "OK should be a nil error")
+	_, ok = FromError(errors.New("plain"))
+	_assert(!ok && Code(errors.New("plain")) == codes.Unknown, "plain error should be Unknown")
+	_assert(FromContextError(context.DeadlineExceeded).Code() == codes.DeadlineExceeded, "expect DeadlineExceeded")
+	_assert(FromContextError(context.Canceled).Code() == codes.Canceled, "expect Canceled")
+	_assert(codes.Code(100).String() == "Code(100)", "unknown code string")
+}
@@ -0,0 +1,640 @@
+package myGoRPC
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"myGoRPC/codec"
+	"myGoRPC/codes"
+	"myGoRPC/metadata"
+	"myGoRPC/status"
+	"reflect"
+	"sync"
+	"time"
+)
+
+/*
+流式调用
+
+与普通调用共用连接与 Seq：
+
+	客户端 --KindStream（参数）--> 服务端
+	客户端 <--KindStreamMsg（消息）-- 服务端     （0 到多条）
+	客户端 --KindStreamWindow--> 服务端          （处理了一半窗口的消息后归还额度）
+	客户端 <--KindStreamEnd（结果）-- 服务端
+
+客户端流（方法的参数为 <-chan T）在此基础上，客户端同样发送消息，服务端同样归还额度：
+
+	客户端 --KindStreamMsg（参数）--> 服务端     （0 到多条）
+	客户端 <--KindStreamWindow-- 服务端
+	客户端 --KindStreamEnd--> 服务端             （结束发送，方法的参数 channel 被关闭）
+
+客户端打开流时通过 Header.Window 告知初始窗口，两个方向使用相同的窗口大小，
+发送方最多发送窗口内的消息，之后等待接收方归还额度；
+客户端取消流时发送 KindCancel，服务端方法的 ctx 被取消，不再发送 KindStreamEnd；
+服务端以错误结束流（方法返回错误、超时、客户端没有遵守窗口等）时，KindStreamEnd 携带该错误的 status
+*/
+
+const (
+	// DefaultStreamWindow Option.StreamWindow 为 0 时的窗口大小
+	DefaultStreamWindow = 64
+	// MaxStreamWindow 窗口的上限：服务端按窗口分配客户端流的缓冲区，打开流时窗口超出的请求回复 codes.InvalidArgument
+	MaxStreamWindow = 4096
+)
+
+/*
+window
+流量控制的额度，发送方每发送一条消息消耗 1，接收方处理后通过 KindStreamWindow 归还
+*/
+type window struct {
+	mu     sync.Mutex
+	credit uint32
+	wake   chan struct{}
+}
+
+func newWindow(n uint32) *window {
+	if n == 0 {
+		n = DefaultStreamWindow
+	}
+	return &window{credit: min(n, MaxStreamWindow), wake: make(chan struct{}, 1)}
+}
+
+// grant 增加额度，额度不超过 MaxStreamWindow，对方归还过多的额度不会溢出
+func (w *window) grant(n uint32) {
+	w.mu.Lock()
+	w.credit = uint32(min(uint64(w.credit)+uint64(n), MaxStreamWindow))
+	w.mu.Unlock()
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// acquire 消耗 1 个额度，没有额度时等待 grant，ctx 结束时返回 ctx.Err()
+func (w *window) acquire(ctx context.Context) error {
+	for {
+		w.mu.Lock()
+		if w.credit > 0 {
+			w.credit--
+			w.mu.Unlock()
+			return nil
+		}
+		w.mu.Unlock()
+		select {
+		case <-w.wake:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// ------------------ 服务端 ------------------
+
+/*
+handleStream
+与 handleRequest 类似，方法在独立的协程中执行，向 req.replyV（无缓冲的 channel）发送消息，
+这里逐条转发为 KindStreamMsg，方法返回后发送 KindStreamEnd；
+只有客户端流时，方法返回后把 req.replyV 作为唯一的一条 KindStreamMsg 发送。
+客户端流的消息由 forwardStream 转发给方法（req.argV）。
+
+ctx 结束后不再转发，继续在后台接收并丢弃方法发送的消息直到方法返回，方法不会因此阻塞；
+回复见 cancelStream
+*/
+func (server *Server) handleStream(cc codec.Codec, req *request, w *window, in *inbound, sending *sync.Mutex, c *serverConn, timeout time.Duration) {
+	defer c.done()
+	defer c.leave()
+	seq := req.header.Seq
+	if err := server.authorize(req); err != nil {
+		server.endStream(cc, seq, err, sending)
+		return
+	}
+	ctx, cancel := server.handleContext(req, timeout)
+	defer cancel()
+	release, err := server.acquire(ctx, c)
+	if err != nil {
+		if ctx.Err() != nil {
+			server.cancelStream(ctx, cc, seq, sending)
+		} else {
+			server.endStream(cc, seq, err, sending)
+		}
+		return
+	}
+
+	if in != nil {
+		forwarded := make(chan struct{})
+		go func() {
+			server.forwardStream(ctx, cc, seq, in, req.argV, sending)
+			close(forwarded)
+		}()
+		// 等待 forwardStream 退出，连接关闭前不再有写入
+		defer func() {
+			cancel()
+			<-forwarded
+		}()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		defer release()
+		done <- server.call(ctx, req)
+	}()
+
+	if !req.mtype.ServerStream {
+		select {
+		case err := <-done:
+			if err == nil {
+				h := codec.Header{Kind: codec.KindStreamMsg, Seq: seq}
+				if err = server.writeStream(cc, &h, req.replyV.Interface(), sending); err != nil {
+					if !codec.IsMessageError(err) {
+						return
+					}
+					err = status.Error(codes.Internal, "rpc server: encode reply error: "+err.Error())
+				}
+			}
+			server.endStream(cc, seq, err, sending)
+		case <-ctx.Done():
+			server.cancelStream(ctx, cc, seq, sending)
+		}
+		return
+	}
+
+	cases := []reflect.SelectCase{
+		{Dir: reflect.SelectRecv, Chan: req.replyV},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(done)},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())},
+	}
+	for {
+		chosen, v, _ := reflect.Select(cases)
+		switch chosen {
+		case 0:
+			if w.acquire(ctx) != nil {
+				// ctx 已结束，丢弃这条消息，下一轮处理
+				continue
+			}
+			h := codec.Header{Kind: codec.KindStreamMsg, Seq: seq}
+			if err := server.writeStream(cc, &h, v.Interface(), sending); err != nil {
+				go drainStream(req.replyV, done)
+				if codec.IsMessageError(err) {
+					server.endStream(cc, seq, status.Error(codes.Internal, "rpc server: encode stream message error: "+err.Error()), sending)
+				}
+				return
+			}
+		case 1:
+			err, _ := v.Interface().(error)
+			server.endStream(cc, seq, err, sending)
+			return
+		case 2:
+			go drainStream(req.replyV, done)
+			server.cancelStream(ctx, cc, seq, sending)
+			return
+		}
+	}
+}
+
+/*
+cancelStream
+ctx 结束后的回复：超时回复 codes.DeadlineExceeded，服务端中止（见 inflight.abort）回复中止的原因，
+客户端取消或者断开时不再回复
+*/
+func (server *Server) cancelStream(ctx context.Context, cc codec.Codec, seq uint64, sending *sync.Mutex) {
+	if ctx.Err() == context.DeadlineExceeded {
+		server.endStream(cc, seq, status.Error(codes.DeadlineExceeded, "rpc server: request handle timeout"), sending)
+		return
+	}
+	if cause := context.Cause(ctx); cause != context.Canceled {
+		server.endStream(cc, seq, cause, sending)
+	}
+}
+
+/*
+inbound
+客户端流中已经到达、尚未被方法接收的消息，容量为窗口大小
+*/
+type inbound struct {
+	typ    reflect.Type // 消息类型，即方法参数 <-chan T 的 T
+	window uint32
+	msgs   chan reflect.Value
+
+	mu     sync.Mutex // 保护 msgs 的发送与关闭
+	closed bool
+}
+
+func newInbound(typ reflect.Type, n uint32) *inbound {
+	if n == 0 {
+		n = DefaultStreamWindow
+	}
+	// readRequest 已经拒绝了超出上限的窗口
+	n = min(n, MaxStreamWindow)
+	return &inbound{typ: typ, window: n, msgs: make(chan reflect.Value, n)}
+}
+
+// push 缓冲区已满（客户端没有遵守窗口）时返回 false，结束发送后到达的消息直接丢弃
+func (in *inbound) push(v reflect.Value) bool {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if in.closed {
+		return true
+	}
+	select {
+	case in.msgs <- v:
+		return true
+	default:
+		return false
+	}
+}
+
+func (in *inbound) closeSend() {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if !in.closed {
+		in.closed = true
+		close(in.msgs)
+	}
+}
+
+/*
+receive
+读取客户端流的一条消息，流不存在（已经结束）时丢弃；
+消息无法解码或者客户端没有遵守窗口时以错误结束该流（见 abort），
+返回的错误意味着数据流已经错位
+*/
+func (f *inflight) receive(cc codec.Codec, seq uint64) error {
+	f.mu.Lock()
+	in := f.inbounds[seq]
+	f.mu.Unlock()
+	if in == nil {
+		return cc.ReadBody(nil)
+	}
+
+	var v, ptr reflect.Value
+	if in.typ.Kind() == reflect.Ptr {
+		v = reflect.New(in.typ.Elem())
+		ptr = v
+	} else {
+		ptr = reflect.New(in.typ)
+		v = ptr.Elem()
+	}
+	if err := cc.ReadBody(ptr.Interface()); err != nil {
+		if !codec.IsMessageError(err) {
+			return err
+		}
+		if errors.Is(err, codec.ErrBodyTooLarge) {
+			f.abort(seq, status.Error(codes.ResourceExhausted, "rpc server: stream message too large: "+err.Error()))
+		} else {
+			f.abort(seq, status.Error(codes.InvalidArgument, "rpc server: decode stream message error: "+err.Error()))
+		}
+		return nil
+	}
+	if !in.push(v) {
+		f.abort(seq, status.Error(codes.ResourceExhausted, "rpc server: stream window exceeded"))
+	}
+	return nil
+}
+
+// closeSend 处理客户端的 codec.KindStreamEnd，流不存在（已经结束）时忽略
+func (f *inflight) closeSend(seq uint64) {
+	f.mu.Lock()
+	in := f.inbounds[seq]
+	f.mu.Unlock()
+	if in != nil {
+		in.closeSend()
+	}
+}
+
+/*
+forwardStream
+把客户端流的消息逐条转发给方法（argV，无缓冲的 channel），方法每接收一半窗口的消息归还一次额度；
+客户端结束发送或者 ctx 结束时关闭 argV，方法可以通过 ctx.Err() 区分两者
+*/
+func (server *Server) forwardStream(ctx context.Context, cc codec.Codec, seq uint64, in *inbound, argV reflect.Value, sending *sync.Mutex) {
+	defer argV.Close()
+	var consumed uint32
+	for {
+		var v reflect.Value
+		select {
+		case msg, ok := <-in.msgs:
+			if !ok {
+				return
+			}
+			v = msg
+		case <-ctx.Done():
+			return
+		}
+		cases := []reflect.SelectCase{
+			{Dir: reflect.SelectSend, Chan: argV, Send: v},
+			{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())},
+		}
+		if chosen, _, _ := reflect.Select(cases); chosen == 1 {
+			return
+		}
+		if consumed++; consumed >= (in.window+1)/2 {
+			h := codec.Header{Kind: codec.KindStreamWindow, Seq: seq, Window: consumed}
+			_ = server.writeStream(cc, &h, invalidRequest, sending)
+			consumed = 0
+		}
+	}
+}
+
+// drainStream 丢弃方法发送的消息直到方法返回
+func drainStream(replyV reflect.Value, done <-chan error) {
+	cases := []reflect.SelectCase{
+		{Dir: reflect.SelectRecv, Chan: replyV},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(done)},
+	}
+	for {
+		if chosen, _, _ := reflect.Select(cases); chosen == 1 {
+			return
+		}
+	}
+}
+
+// writeStream 与 sendResponse 不同，编码失败时返回错误，由调用方结束流
+func (server *Server) writeStream(cc codec.Codec, h *codec.Header, body interface{}, sending *sync.Mutex) error {
+	sending.Lock()
+	defer sending.Unlock()
+	err := cc.Write(h, body)
+	if err != nil {
+		log.Println("rpc server: write stream error: ", err)
+	}
+	return err
+}
+
+func (server *Server) endStream(cc codec.Codec, seq uint64, err error, sending *sync.Mutex) {
+	h := codec.Header{Kind: codec.KindStreamEnd, Seq: seq}
+	if err != nil {
+		server.setStatus(&h, err)
+	}
+	server.sendResponse(cc, &h, invalidRequest, sending)
+}
+
+// ------------------ 客户端 ------------------
+
+/*
+Stream
+客户端的流，由 Client.NewStream 打开；Recv、Send 各自不能并发调用，两者可以在不同的协程中同时调用
+*/
+type Stream struct {
+	client   *Client
+	seq      uint64
+	typ      reflect.Type // 消息类型，每条消息解码到 reflect.New(typ)
+	window   uint32
+	consumed uint32 // Recv 处理的、尚未归还的消息数
+	msgs     chan interface{}
+	send     *window // Send 的额度，由服务端归还
+	ctx      context.Context
+	cancel   context.CancelFunc
+
+	mu         sync.Mutex // 保护以下
+	finished   bool
+	err        error
+	sendClosed bool
+}
+
+// ErrSendClosed CloseSend 之后调用 Send 返回的错误
+var ErrSendClosed = errors.New("rpc client: send on closed stream")
+
+/*
+NewStream
+打开流，service.method 的类型决定了流的方向：
+1. 服务端流：最后一个入参为 chan<- T，reply 为 *T 类型的指针，只用于确定消息类型
+2. 客户端流：参数为 <-chan A，通过 Send 发送参数，reply 为方法的 reply 类型，结果见 CloseAndRecv
+3. 双向流：两者同时使用，Send 与 Recv 可以交替或者并发进行
+
+客户端流与双向流打开时没有参数，args 传 nil；
+ctx 的 Metadata、截止时间随请求发送，ctx 结束或者调用 Stream.Close 时取消流
+*/
+func (client *Client) NewStream(ctx context.Context, service, method string, args, reply interface{}) (*Stream, error) {
+	if reply == nil || reflect.TypeOf(reply).Kind() != reflect.Ptr {
+		return nil, errors.New("rpc client: stream reply must be a pointer")
+	}
+	w := uint32(client.option.StreamWindow)
+	if w == 0 {
+		w = DefaultStreamWindow
+	}
+	w = min(w, MaxStreamWindow)
+	ctx, cancel := context.WithCancel(ctx)
+	s := &Stream{
+		client: client,
+		typ:    reflect.TypeOf(reply).Elem(),
+		window: w,
+		msgs:   make(chan interface{}, w),
+		send:   newWindow(w),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	if args == nil {
+		args = invalidRequest
+	}
+	seq, err := client.registerStream(s)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	h := codec.Header{Service: service, Method: method, Seq: seq, Kind: codec.KindStream, Window: w}
+	if md, ok := metadata.FromOutgoingContext(ctx); ok {
+		h.Metadata = md
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		h.Timeout = timeoutOf(deadline)
+	}
+	client.sending.Lock()
+	err = client.cc.Write(&h, args)
+	client.sending.Unlock()
+	if err != nil {
+		client.removeStream(seq)
+		client.closeIfIdle()
+		cancel()
+		return nil, err
+	}
+
+	context.AfterFunc(ctx, func() {
+		s.fail(status.FromContextError(ctx.Err()).Err())
+	})
+	return s, nil
+}
+
+/*
+Recv
+返回下一条消息（*T），流正常结束时返回 io.EOF，否则返回服务端的错误（见 status.Code）
+*/
+func (s *Stream) Recv() (interface{}, error) {
+	v, ok := <-s.msgs
+	if !ok {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return nil, s.err
+	}
+	if s.consumed++; s.consumed >= (s.window+1)/2 {
+		s.client.sendControl(codec.Header{Kind: codec.KindStreamWindow, Seq: s.seq, Window: s.consumed})
+		s.consumed = 0
+	}
+	return v, nil
+}
+
+/*
+Send
+向服务端发送一条消息（方法参数 <-chan A 的 A），没有额度时等待服务端归还；
+流已经结束时返回 io.EOF，结果通过 Recv 得到
+*/
+func (s *Stream) Send(args interface{}) error {
+	s.mu.Lock()
+	finished, sendClosed := s.finished, s.sendClosed
+	s.mu.Unlock()
+	if finished {
+		return io.EOF
+	}
+	if sendClosed {
+		return ErrSendClosed
+	}
+	if s.send.acquire(s.ctx) != nil {
+		return io.EOF
+	}
+	h := codec.Header{Kind: codec.KindStreamMsg, Seq: s.seq}
+	s.client.sending.Lock()
+	defer s.client.sending.Unlock()
+	return s.client.cc.Write(&h, args)
+}
+
+// CloseSend 结束发送，服务端方法的参数 channel 被关闭；之后仍然可以 Recv
+func (s *Stream) CloseSend() error {
+	s.mu.Lock()
+	if s.finished || s.sendClosed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.sendClosed = true
+	s.mu.Unlock()
+	s.client.sendControl(codec.Header{Kind: codec.KindStreamEnd, Seq: s.seq})
+	return nil
+}
+
+/*
+CloseAndRecv
+用于客户端流：结束发送，等待方法返回，得到唯一的结果（*T）
+*/
+func (s *Stream) CloseAndRecv() (interface{}, error) {
+	if err := s.CloseSend(); err != nil {
+		return nil, err
+	}
+	v, err := s.Recv()
+	if err != nil {
+		return nil, err
+	}
+	if _, err = s.Recv(); err != io.EOF {
+		if err == nil {
+			_ = s.Close()
+			err = errors.New("rpc client: more than one reply on stream, use Recv")
+		}
+		return nil, err
+	}
+	return v, nil
+}
+
+// Close 取消流，服务端方法的 ctx 随之被取消；流已经结束时没有影响
+func (s *Stream) Close() error {
+	s.cancel()
+	return nil
+}
+
+// push 由 receive 调用，接收方的缓冲区已满（服务端没有遵守窗口）时返回 false
+func (s *Stream) push(v interface{}) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.finished {
+		return true
+	}
+	select {
+	case s.msgs <- v:
+		return true
+	default:
+		return false
+	}
+}
+
+// finish 结束流，之后 Recv 读完缓冲区中的消息后返回 err
+func (s *Stream) finish(err error) {
+	s.mu.Lock()
+	if s.finished {
+		s.mu.Unlock()
+		return
+	}
+	s.finished = true
+	s.err = err
+	close(s.msgs)
+	s.mu.Unlock()
+	s.cancel()
+}
+
+// fail 由客户端结束流，流仍在进行时通知服务端取消
+func (s *Stream) fail(err error) {
+	if s.client.removeStream(s.seq) != nil {
+		go func() {
+			s.client.sendControl(codec.Header{Kind: codec.KindCancel, Seq: s.seq})
+			s.client.closeIfIdle()
+		}()
+	}
+	s.finish(err)
+}
+
+func (client *Client) registerStream(s *Stream) (uint64, error) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.closing || client.shutdown || client.goAway || client.draining {
+		return 0, ErrShutdown
+	}
+	s.seq = client.seq
+	client.streams[s.seq] = s
+	client.seq++
+	return s.seq, nil
+}
+
+func (client *Client) removeStream(seq uint64) *Stream {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	s := client.streams[seq]
+	delete(client.streams, seq)
+	return s
+}
+
+/*
+receiveStream
+处理 KindStreamMsg、KindStreamEnd 与 KindStreamWindow，返回的错误意味着数据流已经错位，与 receive 相同
+*/
+func (client *Client) receiveStream(h *codec.Header) error {
+	client.mu.Lock()
+	s := client.streams[h.Seq]
+	client.mu.Unlock()
+	if s == nil {
+		// 流已经被取消
+		return client.cc.ReadBody(nil)
+	}
+	if h.Kind == codec.KindStreamWindow {
+		s.send.grant(h.Window)
+		return client.cc.ReadBody(nil)
+	}
+	if h.Kind == codec.KindStreamEnd {
+		client.removeStream(h.Seq)
+		err := client.cc.ReadBody(nil)
+		if serr := headerError(h); serr != nil {
+			s.finish(serr)
+		} else {
+			s.finish(io.EOF)
+		}
+		return err
+	}
+
+	v := reflect.New(s.typ).Interface()
+	if err := client.cc.ReadBody(v); err != nil {
+		if !codec.IsMessageError(err) {
+			return err
+		}
+		s.fail(status.Error(codes.Internal, "rpc client: decode stream message error: "+err.Error()))
+		return nil
+	}
+	if !s.push(v) {
+		s.fail(status.Error(codes.ResourceExhausted, "rpc client: stream window exceeded"))
+	}
+	return nil
+}
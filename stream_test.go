@@ -0,0 +1,252 @@
+package myGoRPC
+
+import (
+	"context"
+	"io"
+	"math"
+	"myGoRPC/codec"
+	"myGoRPC/codes"
+	"myGoRPC/status"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type Row struct{ I int }
+
+type Report struct {
+	sent     int64      // Forever 发送的消息数
+	canceled chan error // Forever 的 ctx 被取消的原因
+}
+
+func (r *Report) Rows(ctx context.Context, n int, stream chan<- *Row) error {
+	for i := 0; i < n; i++ {
+		select {
+		case stream <- &Row{I: i}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (r *Report) Fail(n int, stream chan<- int) error {
+	for i := 0; i < n; i++ {
+		stream <- i
+	}
+	return status.Error(codes.PermissionDenied, "no more rows")
+}
+
+func (r *Report) Forever(ctx context.Context, n int, stream chan<- int) error {
+	for {
+		select {
+		case stream <- n:
+			atomic.AddInt64(&r.sent, 1)
+		case <-ctx.Done():
+			r.canceled <- ctx.Err()
+			return ctx.Err()
+		}
+	}
+}
+
+func (r *Report) Count(n int, reply *int) error {
+	*reply = n
+	return nil
+}
+
+func (r *Report) Sum(ctx context.Context, stream <-chan int, reply *int) error {
+	for n := range stream {
+		*reply += n
+	}
+	return ctx.Err()
+}
+
+func (r *Report) Echo(ctx context.Context, in <-chan *Row, out chan<- *Row) error {
+	for row := range in {
+		if row.I < 0 {
+			return status.Error(codes.InvalidArgument, "negative row")
+		}
+		select {
+		case out <- row:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return ctx.Err()
+}
+
+// Hold 不接收参数，直到流被取消
+func (r *Report) Hold(ctx context.Context, stream <-chan int, reply *int) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func startReportServer(t *testing.T) (*Report, string) {
+	report := &Report{canceled: make(chan error, 1)}
+	server := NewServer()
+	_ = server.Register(report)
+	l, err := net.Listen("tcp", ":0")
+	_assert(err == nil, "failed to listen: %v", err)
+	go server.Accept(l)
+	t.Cleanup(func() { _ = server.Close() })
+	return report, l.Addr().String()
+}
+
+/*
+测试服务端流。
+消息按顺序到达，与普通调用复用同一个连接；方法返回错误时流以该错误结束
+*/
+func TestStream(t *testing.T) {
+	t.Parallel()
+	_, addr := startReportServer(t)
+	client, err := Dial("tcp", addr, &Option{StreamWindow: 8})
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+
+	stream, err := client.NewStream(context.Background(), "Report", "Rows", 1000, new(Row))
+	_assert(err == nil, "failed to open stream: %v", err)
+	var n int
+	_assert(client.Call(context.Background(), "Report", "Count", 7, &n) == nil && n == 7, "unary call on a streaming connection failed")
+	for i := 0; i < 1000; i++ {
+		v, err := stream.Recv()
+		_assert(err == nil && v.(*Row).I == i, "expect row %d, got %v, err %v", i, v, err)
+	}
+	_, err = stream.Recv()
+	_assert(err == io.EOF, "expect io.EOF, got %v", err)
+
+	stream, err = client.NewStream(context.Background(), "Report", "Fail", 3, new(int))
+	_assert(err == nil, "failed to open stream: %v", err)
+	for i := 0; i < 3; i++ {
+		v, err := stream.Recv()
+		_assert(err == nil && *v.(*int) == i, "expect %d, got %v, err %v", i, v, err)
+	}
+	_, err = stream.Recv()
+	_assert(status.Code(err) == codes.PermissionDenied, "expect PermissionDenied, got %v", err)
+
+	err = client.Call(context.Background(), "Report", "Rows", 1, &n)
+	_assert(status.Code(err) == codes.InvalidArgument, "expect InvalidArgument calling a streaming method, got %v", err)
+	stream, err = client.NewStream(context.Background(), "Report", "Count", 1, new(int))
+	_assert(err == nil, "failed to open stream: %v", err)
+	_, err = stream.Recv()
+	_assert(status.Code(err) == codes.InvalidArgument, "expect InvalidArgument streaming a unary method, got %v", err)
+}
+
+/*
+测试流量控制与取消。
+客户端不调用 Recv 时，服务端最多发送窗口内的消息；Close 后服务端方法的 ctx 被取消
+*/
+func TestStream_FlowControl(t *testing.T) {
+	t.Parallel()
+	report, addr := startReportServer(t)
+	client, err := Dial("tcp", addr, &Option{StreamWindow: 4})
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+
+	stream, err := client.NewStream(context.Background(), "Report", "Forever", 1, new(int))
+	_assert(err == nil, "failed to open stream: %v", err)
+	time.Sleep(time.Millisecond * 100)
+	// 窗口内的 4 条消息已经发出，第 5 条等待额度
+	_assert(atomic.LoadInt64(&report.sent) <= 5, "server ignored the window, sent %d", atomic.LoadInt64(&report.sent))
+	for i := 0; i < 10; i++ {
+		_, err = stream.Recv()
+		_assert(err == nil, "failed to recv: %v", err)
+	}
+
+	_ = stream.Close()
+	select {
+	case err = <-report.canceled:
+		_assert(err == context.Canceled, "expect canceled, got %v", err)
+	case <-time.After(time.Second):
+		t.Fatal("server stream is not canceled")
+	}
+	// 读完缓冲区中的消息后返回取消的错误
+	var recvErr error
+	for recvErr == nil {
+		_, recvErr = stream.Recv()
+	}
+	_assert(status.Code(recvErr) == codes.Canceled, "expect Canceled, got %v", recvErr)
+}
+
+/*
+测试客户端流与双向流。
+客户端流发送的消息多于窗口时依赖服务端归还额度；双向流交替收发，方法返回的错误随 KindStreamEnd 到达
+*/
+func TestStream_ClientStream(t *testing.T) {
+	t.Parallel()
+	_, addr := startReportServer(t)
+	client, err := Dial("tcp", addr, &Option{StreamWindow: 8})
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+
+	stream, err := client.NewStream(context.Background(), "Report", "Sum", nil, new(int))
+	_assert(err == nil, "failed to open stream: %v", err)
+	for i := 1; i <= 100; i++ {
+		_assert(stream.Send(i) == nil, "failed to send %d", i)
+	}
+	v, err := stream.CloseAndRecv()
+	_assert(err == nil && *v.(*int) == 5050, "expect 5050, got %v, err %v", v, err)
+	_assert(stream.Send(1) != nil, "send on a finished stream should fail")
+
+	stream, err = client.NewStream(context.Background(), "Report", "Echo", nil, new(Row))
+	_assert(err == nil, "failed to open stream: %v", err)
+	for i := 0; i < 100; i++ {
+		_assert(stream.Send(&Row{I: i}) == nil, "failed to send %d", i)
+		v, err := stream.Recv()
+		_assert(err == nil && v.(*Row).I == i, "expect row %d, got %v, err %v", i, v, err)
+	}
+	_ = stream.CloseSend()
+	_assert(stream.Send(&Row{}) == ErrSendClosed, "expect ErrSendClosed")
+	_, err = stream.Recv()
+	_assert(err == io.EOF, "expect io.EOF, got %v", err)
+
+	stream, err = client.NewStream(context.Background(), "Report", "Echo", nil, new(Row))
+	_assert(err == nil, "failed to open stream: %v", err)
+	_ = stream.Send(&Row{I: -1})
+	_, err = stream.Recv()
+	_assert(status.Code(err) == codes.InvalidArgument, "expect InvalidArgument, got %v", err)
+}
+
+/*
+测试客户端流的流量控制。
+服务端方法不接收时，客户端最多发送窗口内的消息，之后 Send 阻塞直到流结束
+*/
+func TestStream_SendWindow(t *testing.T) {
+	t.Parallel()
+	_, addr := startReportServer(t)
+	client, err := Dial("tcp", addr, &Option{StreamWindow: 4})
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer cancel()
+	stream, err := client.NewStream(ctx, "Report", "Hold", nil, new(int))
+	_assert(err == nil, "failed to open stream: %v", err)
+	for i := 0; i < 4; i++ {
+		_assert(stream.Send(i) == nil, "failed to send %d", i)
+	}
+	start := time.Now()
+	_assert(stream.Send(4) == io.EOF, "expect io.EOF after the stream timed out")
+	_assert(time.Since(start) > time.Millisecond*100, "send did not wait for the window")
+	_, err = stream.Recv()
+	_assert(status.Code(err) == codes.DeadlineExceeded, "expect DeadlineExceeded, got %v", err)
+}
+
+// 测试打开流时超出 MaxStreamWindow 的窗口在分配缓冲区之前被拒绝，连接继续可用
+func TestStream_MaxWindow(t *testing.T) {
+	t.Parallel()
+	_, addr := startReportServer(t)
+	cc := dialCodec(t, addr, &Option{})
+	h := codec.Header{Service: "Report", Method: "Sum", Seq: 1, Kind: codec.KindStream, Window: math.MaxUint32}
+	_assert(cc.Write(&h, invalidRequest) == nil, "failed to open stream")
+	_assert(cc.ReadHeader(&h) == nil && h.Kind == codec.KindStreamEnd && codes.Code(h.Code) == codes.InvalidArgument, "expect InvalidArgument, got %+v", h)
+	_assert(cc.ReadBody(nil) == nil, "failed to read body")
+
+	client, err := Dial("tcp", addr, &Option{StreamWindow: math.MaxInt32})
+	_assert(err == nil, "failed to dial: %v", err)
+	defer func() { _ = client.Close() }()
+	stream, err := client.NewStream(context.Background(), "Report", "Sum", nil, new(int))
+	_assert(err == nil && stream.Send(1) == nil, "a client window above the limit should be clamped, got %v", err)
+	reply, err := stream.CloseAndRecv()
+	_assert(err == nil && *reply.(*int) == 1, "expect 1, got %v, err %v", reply, err)
+}
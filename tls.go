@@ -0,0 +1,76 @@
+package myGoRPC
+
+import (
+	"crypto/tls"
+	"io"
+	"myGoRPC/peer"
+	"net"
+)
+
+/*
+AcceptTLS
+与 Accept 相同，连接先完成 TLS 握手；
+config 的 ClientAuth 为 tls.RequireAndVerifyClientCert 等值时验证客户端证书（双向认证），
+方法通过 peer.FromContext 得到客户端的证书
+*/
+func (server *Server) AcceptTLS(listen net.Listener, config *tls.Config) {
+	server.Accept(tls.NewListener(listen, config))
+}
+
+/*
+ListenAndServeTLS
+监听 address 并通过 AcceptTLS 处理连接，总是返回非 nil 的错误：
+Shutdown、Close 之后为 ErrServerClosed，否则为监听或者 Accept 的错误
+*/
+func (server *Server) ListenAndServeTLS(network, address string, config *tls.Config) error {
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+	return server.serve(tls.NewListener(l, config))
+}
+
+// newPeer 得到连接的地址，*tls.Conn 先完成握手，握手失败时返回错误
+func newPeer(conn io.ReadWriteCloser) (*peer.Peer, error) {
+	p := &peer.Peer{}
+	if c, ok := conn.(net.Conn); ok {
+		p.Addr = c.RemoteAddr()
+	}
+	if c, ok := conn.(*tls.Conn); ok {
+		if err := c.Handshake(); err != nil {
+			return nil, err
+		}
+		state := c.ConnectionState()
+		p.TLS = &state
+	}
+	return p, nil
+}
+
+/*
+DialTLS
+与 Dial 相同，通过 TLS 连接服务端，config 不为 nil 时覆盖 Option.TLSConfig；
+两者都为 nil 时使用系统的根证书验证服务端，ServerName 为空时取自 address
+*/
+func DialTLS(network, address string, config *tls.Config, opts ...*Option) (*Client, error) {
+	opt, err := parseOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
+	o := *opt
+	if config != nil {
+		o.TLSConfig = config
+	}
+	if o.TLSConfig == nil {
+		o.TLSConfig = &tls.Config{}
+	}
+	return dialTimeout(NewClient, network, address, &o)
+}
+
+// dialConn 建立连接，Option.TLSConfig 不为 nil 时在 ConnectTimeout 内完成 TLS 握手
+func dialConn(network, address string, opt *Option) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: opt.ConnectTimeout}
+	if opt.TLSConfig == nil {
+		return dialer.Dial(network, address)
+	}
+	return tls.DialWithDialer(dialer, network, address, opt.TLSConfig)
+}
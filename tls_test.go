@@ -0,0 +1,137 @@
+package myGoRPC
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"myGoRPC/peer"
+	"net"
+	"testing"
+	"time"
+)
+
+type Who int
+
+// Whoami 返回客户端证书的 CommonName，没有客户端证书时返回 anonymous，明文连接返回 plaintext
+func (w Who) Whoami(ctx context.Context, _ int, reply *string) error {
+	p, _ := peer.FromContext(ctx)
+	switch {
+	case p == nil || p.TLS == nil:
+		*reply = "plaintext"
+	case p.Certificate() == nil:
+		*reply = "anonymous"
+	default:
+		*reply = p.Certificate().Subject.CommonName
+	}
+	return nil
+}
+
+// testPKI 内存中生成的 CA，以及由它签发的服务端、客户端证书
+type testPKI struct {
+	pool   *x509.CertPool
+	server tls.Certificate
+	client tls.Certificate
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_assert(err == nil, "failed to generate key: %v", err)
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	_assert(err == nil, "failed to create ca: %v", err)
+	ca, _ = x509.ParseCertificate(der)
+
+	issue := func(serial int64, cn string, usage x509.ExtKeyUsage) tls.Certificate {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		_assert(err == nil, "failed to generate key: %v", err)
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: cn},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+			IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+		_assert(err == nil, "failed to issue %s: %v", cn, err)
+		return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	}
+	pki := &testPKI{pool: x509.NewCertPool()}
+	pki.pool.AddCert(ca)
+	pki.server = issue(2, "server", x509.ExtKeyUsageServerAuth)
+	pki.client = issue(3, "alice", x509.ExtKeyUsageClientAuth)
+	return pki
+}
+
+func startTLSServer(t *testing.T, config *tls.Config) string {
+	server := NewServer()
+	_ = server.Register(new(Who))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	_assert(err == nil, "failed to listen: %v", err)
+	go server.AcceptTLS(l, config)
+	t.Cleanup(func() { _ = server.Close() })
+	return l.Addr().String()
+}
+
+/*
+测试 TLS 与双向认证。
+客户端验证服务端证书；服务端要求客户端证书时，没有证书的客户端无法连接，方法可以得到客户端的身份
+*/
+func TestTLS(t *testing.T) {
+	t.Parallel()
+	pki := newTestPKI(t)
+
+	addr := startTLSServer(t, &tls.Config{Certificates: []tls.Certificate{pki.server}})
+	client, err := DialTLS("tcp", addr, &tls.Config{RootCAs: pki.pool})
+	_assert(err == nil, "failed to dial tls: %v", err)
+	var reply string
+	err = client.Call(context.Background(), "Who", "Whoami", 0, &reply)
+	_assert(err == nil && reply == "anonymous", "expect anonymous, got %q, err %v", reply, err)
+	_ = client.Close()
+
+	_, err = DialTLS("tcp", addr, &tls.Config{}, &Option{ConnectTimeout: time.Second})
+	_assert(err != nil, "expect an unknown authority error")
+	client, err = DialTLS("tcp", addr, nil, &Option{TLSConfig: &tls.Config{RootCAs: pki.pool}})
+	_assert(err == nil, "a nil config should fall back to Option.TLSConfig: %v", err)
+	_ = client.Close()
+
+	mtls := startTLSServer(t, &tls.Config{
+		Certificates: []tls.Certificate{pki.server},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pki.pool,
+	})
+	_, err = DialTLS("tcp", mtls, &tls.Config{RootCAs: pki.pool}, &Option{ConnectTimeout: time.Second})
+	_assert(err != nil, "expect dial without a client certificate to fail")
+
+	client, err = XDial("tls@"+mtls, &Option{TLSConfig: &tls.Config{RootCAs: pki.pool, Certificates: []tls.Certificate{pki.client}}})
+	_assert(err == nil, "failed to dial mtls: %v", err)
+	defer func() { _ = client.Close() }()
+	err = client.Call(context.Background(), "Who", "Whoami", 0, &reply)
+	_assert(err == nil && reply == "alice", "expect alice, got %q, err %v", reply, err)
+}
+
+// 测试 ListenAndServeTLS 在 Close 之后返回 ErrServerClosed，而不是 nil
+func TestServer_ListenAndServeTLS(t *testing.T) {
+	t.Parallel()
+	server := NewServer()
+	done := make(chan error, 1)
+	go func() { done <- server.ListenAndServeTLS("tcp", "127.0.0.1:0", &tls.Config{}) }()
+	// Close 在 listener 注册之前或之后都会使其返回
+	_ = server.Close()
+	err := <-done
+	_assert(err == ErrServerClosed, "expect ErrServerClosed, got %v", err)
+}
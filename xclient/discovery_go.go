@@ -1,6 +1,7 @@
 package xclient
 
 import (
+	"crypto/tls"
 	"log"
 	"net/http"
 	"strings"
@@ -13,12 +14,14 @@ GoRegistryDiscovery
 registry 注册中心的地址
 timeout 服务列表的过期时间
 lastUpdate 是代表最后从注册中心更新服务列表的时间，默认 10s 过期，即 10s 之后，需要从注册中心更新新的列表
+httpClient 访问注册中心，注册中心使用 HTTPS 时见 NewGoRegistryDiscoveryTLS
 */
 type GoRegistryDiscovery struct {
 	*MultiServerDiscovery
 	registry   string
 	timeout    time.Duration
 	lastUpdate time.Time
+	httpClient *http.Client
 }
 
 const defaultUpdateTimeout = time.Second * 10
@@ -31,9 +34,17 @@ func NewGoRegistryDiscovery(registerAddr string, timeout time.Duration) *GoRegis
 		MultiServerDiscovery: NewMultiServerDiscovery(make([]string, 0)),
 		registry:             registerAddr,
 		timeout:              timeout,
+		httpClient:           http.DefaultClient,
 	}
 }
 
+// NewGoRegistryDiscoveryTLS 通过 HTTPS 访问注册中心，config 用于验证注册中心
+func NewGoRegistryDiscoveryTLS(registerAddr string, timeout time.Duration, config *tls.Config) *GoRegistryDiscovery {
+	d := NewGoRegistryDiscovery(registerAddr, timeout)
+	d.httpClient = &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+	return d
+}
+
 func (d *GoRegistryDiscovery) Update(servers []string) error {
 	d.mu.Lock()
 	defer d.mu.Unlock()
@@ -49,7 +60,7 @@ func (d *GoRegistryDiscovery) Refresh() error {
 		return nil
 	}
 	log.Println("rpc registry: refresh servers from registry ", d.registry)
-	resp, err := http.Get(d.registry)
+	resp, err := d.httpClient.Get(d.registry)
 	if err != nil {
 		log.Println("rpc registry refresh err: ", err)
 		return err
@@ -18,7 +18,7 @@ type XClient struct {
 
 var _ io.Closer = (*XClient)(nil)
 
-func (xc XClient) Close() error {
+func (xc *XClient) Close() error {
 	xc.mu.Lock()
 	defer xc.mu.Unlock()
 	for key, client := range xc.clients {
@@ -46,7 +46,8 @@ func NewXClient(d Discovery, mode SelectMode, opt *myGoRPC.Option) *XClient {
 /*
 dial
 检查 xc.clients 是否有缓存的 Client
-如果有，检查是否是可用状态，如果是则返回缓存的 Client，如果不可用，则从缓存中删除
+如果有，检查是否是可用状态，如果是则返回缓存的 Client，如果不可用，则从缓存中删除；
+不可用的 Client 可能刚收到 GoAway，服务端仍在处理它已发送的请求，因此等这些调用完成后再关闭（CloseIdle）
 上一步中若没有返回缓存的 Client，则说明需要创建新的 Client，缓存并返回
 */
 func (xc *XClient) dial(rpcAddr string) (*myGoRPC.Client, error) {
@@ -54,7 +55,7 @@ func (xc *XClient) dial(rpcAddr string) (*myGoRPC.Client, error) {
 	defer xc.mu.Unlock()
 	client, ok := xc.clients[rpcAddr]
 	if ok && !client.IsAvailable() {
-		_ = client.Close()
+		client.CloseIdle()
 		delete(xc.clients, rpcAddr)
 		client = nil
 	}
@@ -102,6 +103,7 @@ func (xc *XClient) Broadcast(ctx context.Context, service, method string, args,
 
 	replyDone := (reply == nil)
 	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
 	for _, rpcAddr := range servers {
 		wg.Add(1)
@@ -128,3 +130,48 @@ func (xc *XClient) Broadcast(ctx context.Context, service, method string, args,
 	wg.Wait()
 	return e
 }
+
+// Notify 按负载均衡模式选择一个实例发送单向调用，见 myGoRPC.Client.Notify
+func (xc *XClient) Notify(ctx context.Context, service, method string, args interface{}) error {
+	rpcAddr, err := xc.d.Get(xc.mode)
+	if err != nil {
+		return err
+	}
+	client, err := xc.dial(rpcAddr)
+	if err != nil {
+		return err
+	}
+	return client.Notify(ctx, service, method, args)
+}
+
+/*
+BroadcastNotify
+将单向调用发送到所有的服务实例，不等待执行结果；
+返回其中一个发送失败的错误，其他实例仍会收到通知
+*/
+func (xc *XClient) BroadcastNotify(ctx context.Context, service, method string, args interface{}) error {
+	servers, err := xc.d.GetAll()
+	if err != nil {
+		return err
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var e error
+	for _, rpcAddr := range servers {
+		wg.Add(1)
+		go func(rpcAddr string) {
+			defer wg.Done()
+			client, err := xc.dial(rpcAddr)
+			if err == nil {
+				err = client.Notify(ctx, service, method, args)
+			}
+			mu.Lock()
+			if err != nil && e == nil {
+				e = err
+			}
+			mu.Unlock()
+		}(rpcAddr)
+	}
+	wg.Wait()
+	return e
+}